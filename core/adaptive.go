@@ -0,0 +1,261 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveConfigured = "configured" // the rule's TargetSNI
+	adaptiveOtherIP    = "other_ip"   // the rule's TargetSNI on another target
+	adaptiveStrip      = "strip"
+	adaptiveOriginal   = "original"
+	adaptiveAlt        = "alt"
+
+	maxAdaptiveAttempts = 5
+	// adaptiveBudget bounds all attempts of one connection together. Each
+	// attempt gets an equal share of it, but at least minAdaptiveAttempt, so
+	// a silently dropped handshake can't use up the time of the fallbacks.
+	adaptiveBudget     = 15 * time.Second
+	minAdaptiveAttempt = 3 * time.Second
+	adaptiveMemoryTTL  = 7 * 24 * time.Hour
+	adaptiveFileName   = "adaptive_sni.json"
+)
+
+// sniAttempt is one way of reaching a domain upstream. Addr, when set, is
+// the address that last worked and is tried first. Rule fingerprints the SNI
+// settings it was found under, so editing the rule discards it.
+type sniAttempt struct {
+	Kind      string `json:"kind"`
+	SNI       string `json:"sni"`
+	Addr      string `json:"addr,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// adaptiveRuleHash fingerprints the SNI settings an attempt depends on.
+func adaptiveRuleHash(targetSNI string, altSNI []string) string {
+	sum := sha256.Sum256([]byte(targetSNI + "\x00" + strings.Join(altSNI, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// adaptiveMemory remembers per domain the attempt that last succeeded,
+// persisted to dataDir so it survives restarts.
+var adaptiveMemory = struct {
+	sync.Mutex
+	loaded  bool
+	entries map[string]sniAttempt
+}{}
+
+func adaptiveMemoryPath() string {
+	if dataDir == "" {
+		return ""
+	}
+	return filepath.Join(dataDir, adaptiveFileName)
+}
+
+// loadAdaptiveMemoryLocked reads the memory file once. Callers hold the lock.
+func loadAdaptiveMemoryLocked() {
+	if adaptiveMemory.loaded {
+		return
+	}
+	adaptiveMemory.loaded = true
+	adaptiveMemory.entries = make(map[string]sniAttempt)
+
+	path := adaptiveMemoryPath()
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogWarn("Adaptive: Failed to read %s: %v", path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &adaptiveMemory.entries); err != nil {
+		LogWarn("Adaptive: Ignoring corrupt %s: %v", path, err)
+		adaptiveMemory.entries = make(map[string]sniAttempt)
+		return
+	}
+	cutoff := time.Now().Add(-adaptiveMemoryTTL).Unix()
+	for host, a := range adaptiveMemory.entries {
+		if a.UpdatedAt < cutoff {
+			delete(adaptiveMemory.entries, host)
+		}
+	}
+	LogDebug("Adaptive: Loaded %d remembered strategies", len(adaptiveMemory.entries))
+}
+
+// saveAdaptiveMemoryLocked writes the memory file. Callers hold the lock.
+func saveAdaptiveMemoryLocked() {
+	path := adaptiveMemoryPath()
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(adaptiveMemory.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		LogWarn("Adaptive: Failed to write %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		LogWarn("Adaptive: Failed to save %s: %v", path, err)
+	}
+}
+
+// rememberedAttempt returns what last worked for host, unless it is too old
+// or was found under different rule settings than ruleHash.
+func rememberedAttempt(host, ruleHash string) *sniAttempt {
+	adaptiveMemory.Lock()
+	defer adaptiveMemory.Unlock()
+	loadAdaptiveMemoryLocked()
+	a, ok := adaptiveMemory.entries[host]
+	if !ok || a.UpdatedAt < time.Now().Add(-adaptiveMemoryTTL).Unix() || a.Rule != ruleHash {
+		return nil
+	}
+	return &a
+}
+
+func rememberAttempt(host string, a sniAttempt) {
+	adaptiveMemory.Lock()
+	defer adaptiveMemory.Unlock()
+	loadAdaptiveMemoryLocked()
+	a.UpdatedAt = time.Now().Unix()
+	adaptiveMemory.entries[host] = a
+	saveAdaptiveMemoryLocked()
+}
+
+func forgetAttempt(host string) {
+	adaptiveMemory.Lock()
+	defer adaptiveMemory.Unlock()
+	loadAdaptiveMemoryLocked()
+	if _, ok := adaptiveMemory.entries[host]; ok {
+		delete(adaptiveMemory.entries, host)
+		saveAdaptiveMemoryLocked()
+	}
+}
+
+// adaptivePlan lists the attempts for host in order: the remembered one,
+// then the rule's configuration, another target IP, no SNI, the original
+// SNI and each alternative SNI.
+func adaptivePlan(host, targetSNI string, targets []string, altSNI []string, remembered *sniAttempt) []sniAttempt {
+	var plan []sniAttempt
+	add := func(a sniAttempt) {
+		for _, p := range plan {
+			if p.SNI == a.SNI && (p.Kind == adaptiveOtherIP) == (a.Kind == adaptiveOtherIP) {
+				return
+			}
+		}
+		plan = append(plan, a)
+	}
+
+	if remembered != nil {
+		add(*remembered)
+	}
+	add(sniAttempt{Kind: adaptiveConfigured, SNI: targetSNI})
+	if len(targets) > 1 {
+		add(sniAttempt{Kind: adaptiveOtherIP, SNI: targetSNI})
+	}
+	add(sniAttempt{Kind: adaptiveStrip, SNI: ""})
+	add(sniAttempt{Kind: adaptiveOriginal, SNI: host})
+	for _, alt := range altSNI {
+		add(sniAttempt{Kind: adaptiveAlt, SNI: alt})
+	}
+	if len(plan) > maxAdaptiveAttempts {
+		plan = plan[:maxAdaptiveAttempts]
+	}
+	return plan
+}
+
+// adaptiveHandshake is upstreamHandshake for rules in adaptive mode: when the
+// handshake fails it works through adaptivePlan within adaptiveBudget, and
+// remembers the attempt that succeeds. It returns the connection, the
+// address and the SNI used.
+func adaptiveHandshake(host, targetSNI string, targets []string, rule *HostPolicy, ch *clientHelloInfo) (*upstreamConn, string, string, error) {
+	ruleHash := adaptiveRuleHash(targetSNI, rule.AltSNI)
+	remembered := rememberedAttempt(host, ruleHash)
+	plan := adaptivePlan(host, targetSNI, targets, rule.AltSNI, remembered)
+
+	ctx, cancel := context.WithTimeout(context.Background(), adaptiveBudget)
+	defer cancel()
+	perAttempt := adaptiveBudget / time.Duration(len(plan))
+	if perAttempt < minAdaptiveAttempt {
+		perAttempt = minAdaptiveAttempt
+	}
+
+	var lastAddr string
+	var lastErr error
+	for i, a := range plan {
+		if ctx.Err() != nil {
+			break
+		}
+		addrs := targets
+		switch {
+		case a.Kind == adaptiveOtherIP && lastAddr != "":
+			addrs = withoutAddr(targets, lastAddr)
+		case a.Addr != "":
+			addrs = preferAddr(targets, a.Addr)
+		}
+
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, perAttempt)
+		conn, addr, err := upstreamHandshake(attemptCtx, host, a.SNI, addrs, rule, ch)
+		attemptCancel()
+		if err == nil {
+			if i > 0 {
+				LogInfo("Adaptive: %s reached via %s (SNI: %s, %s) after %d failed attempts",
+					host, a.Kind, ptrDisplay(&a.SNI), addr, i)
+			}
+			// The plain configuration working first time isn't worth storing.
+			if i > 0 || (remembered != nil && remembered.Addr != addr) {
+				rememberAttempt(host, sniAttempt{Kind: a.Kind, SNI: a.SNI, Addr: addr, Rule: ruleHash})
+			}
+			return conn, addr, a.SNI, nil
+		}
+
+		lastErr = err
+		if addr != "" {
+			lastAddr = addr
+		}
+		if i == 0 && remembered != nil {
+			forgetAttempt(host)
+		}
+		LogWarn("Adaptive: %s attempt %d/%d (%s, SNI: %s) failed", host, i+1, len(plan), a.Kind, ptrDisplay(&a.SNI))
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, "", "", lastErr
+}
+
+func withoutAddr(addrs []string, skip string) []string {
+	var out []string
+	for _, a := range addrs {
+		if a != skip {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 {
+		return addrs
+	}
+	return out
+}
+
+func preferAddr(addrs []string, first string) []string {
+	for _, a := range addrs {
+		if a == first {
+			return append([]string{first}, withoutAddr(addrs, first)...)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdaptivePlan(t *testing.T) {
+	targets := []string{"192.0.2.1:443", "192.0.2.2:443"}
+	plan := adaptivePlan("www.example.com", "front.example.net", targets, []string{"cdn.example.org", ""}, nil)
+	want := []sniAttempt{
+		{Kind: adaptiveConfigured, SNI: "front.example.net"},
+		{Kind: adaptiveOtherIP, SNI: "front.example.net"},
+		{Kind: adaptiveStrip, SNI: ""},
+		{Kind: adaptiveOriginal, SNI: "www.example.com"},
+		{Kind: adaptiveAlt, SNI: "cdn.example.org"},
+	}
+	if len(plan) != len(want) {
+		t.Fatalf("plan = %+v", plan)
+	}
+	for i := range want {
+		if plan[i].Kind != want[i].Kind || plan[i].SNI != want[i].SNI {
+			t.Errorf("plan[%d] = %+v, want %+v", i, plan[i], want[i])
+		}
+	}
+
+	remembered := &sniAttempt{Kind: adaptiveStrip, SNI: "", Addr: "192.0.2.2:443"}
+	plan = adaptivePlan("www.example.com", "front.example.net", targets[:1], nil, remembered)
+	if len(plan) != 3 || plan[0] != *remembered || plan[1].Kind != adaptiveConfigured || plan[2].Kind != adaptiveOriginal {
+		t.Fatalf("plan with memory = %+v", plan)
+	}
+}
+
+func TestAdaptiveMemoryPersists(t *testing.T) {
+	oldDir := dataDir
+	dataDir = t.TempDir()
+	defer func() {
+		dataDir = oldDir
+		adaptiveMemory.Lock()
+		adaptiveMemory.loaded = false
+		adaptiveMemory.Unlock()
+	}()
+
+	adaptiveMemory.Lock()
+	adaptiveMemory.loaded = false
+	adaptiveMemory.Unlock()
+	ruleHash := adaptiveRuleHash("front.example.net", []string{"cdn.example.org"})
+	rememberAttempt("www.example.com", sniAttempt{Kind: adaptiveAlt, SNI: "cdn.example.org", Addr: "192.0.2.1:443", Rule: ruleHash})
+
+	// Force a reload from disk.
+	adaptiveMemory.Lock()
+	adaptiveMemory.loaded = false
+	adaptiveMemory.Unlock()
+	got := rememberedAttempt("www.example.com", ruleHash)
+	if got == nil || got.Kind != adaptiveAlt || got.SNI != "cdn.example.org" || got.Addr != "192.0.2.1:443" {
+		t.Fatalf("remembered = %+v", got)
+	}
+	// Once the rule's SNI settings change, the old finding no longer applies.
+	if got := rememberedAttempt("www.example.com", adaptiveRuleHash("front2.example.net", []string{"cdn.example.org"})); got != nil {
+		t.Fatalf("attempt survived a rule change: %+v", got)
+	}
+
+	forgetAttempt("www.example.com")
+	adaptiveMemory.Lock()
+	adaptiveMemory.loaded = false
+	adaptiveMemory.Unlock()
+	if got := rememberedAttempt("www.example.com", ruleHash); got != nil {
+		t.Fatalf("forgotten attempt came back: %+v", got)
+	}
+}
+
+func TestAdaptiveHandshakeSurvivesBlackhole(t *testing.T) {
+	// The first target accepts TCP but never answers the ClientHello, like a
+	// DPI box silently dropping it.
+	blackhole, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	go func() {
+		for {
+			conn, err := blackhole.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	good := strings.TrimPrefix(srv.URL, "https://")
+
+	targets := []string{blackhole.Addr().String(), good}
+	start := time.Now()
+	conn, addr, _, err := adaptiveHandshake("blackhole.adaptive-test.invalid", "front.adaptive-test.invalid", targets, &HostPolicy{Adaptive: true, CertVerify: false}, nil)
+	if err != nil {
+		t.Fatalf("no attempt succeeded after %s: %v", time.Since(start), err)
+	}
+	defer conn.Close()
+	forgetAttempt("blackhole.adaptive-test.invalid")
+	if addr != good {
+		t.Fatalf("connected to %s, want %s", addr, good)
+	}
+	if elapsed := time.Since(start); elapsed >= adaptiveBudget {
+		t.Fatalf("took %s, over the %s budget", elapsed, adaptiveBudget)
+	}
+}
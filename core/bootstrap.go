@@ -0,0 +1,170 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultBootstrapDNS = "223.5.5.5:53"
+	// Bootstrap answers are pinned for their TTL, clamped to this range, and
+	// kept past it if a refresh fails.
+	minBootstrapTTL = time.Minute
+	maxBootstrapTTL = time.Hour
+)
+
+// bootstrapResolver resolves the host names of encrypted upstreams (DoH and
+// DoT) through the bootstrap servers, which are never asked anything else.
+type bootstrapResolver struct {
+	backend *stdBackend
+
+	mu     sync.Mutex
+	pinned map[string]pinnedAddrs
+}
+
+type pinnedAddrs struct {
+	ips       []string
+	expiresAt time.Time
+}
+
+func newBootstrapResolver(servers []string, timeout time.Duration) *bootstrapResolver {
+	var upstreams []stdUpstream
+	for _, s := range servers {
+		if s == "" {
+			continue
+		}
+		// Bootstrap servers can't be bootstrapped themselves; a DoH or DoT
+		// one should be given by IP.
+		if u, err := parseUpstream(s, timeout, nil); err == nil {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if len(upstreams) == 0 {
+		u, _ := parseUpstream(defaultBootstrapDNS, timeout, nil)
+		upstreams = append(upstreams, u)
+	}
+	return &bootstrapResolver{
+		backend: newStdBackend(upstreams, timeout, dnsStrategyRace),
+		pinned:  make(map[string]pinnedAddrs),
+	}
+}
+
+// lookup returns the addresses of host, from the pin while it is fresh.
+// When a refresh fails the previous addresses keep being used.
+func (b *bootstrapResolver) lookup(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	b.mu.Lock()
+	pin, ok := b.pinned[host]
+	b.mu.Unlock()
+	if ok && time.Now().Before(pin.expiresAt) {
+		return pin.ips, nil
+	}
+
+	ips, ttl, err := b.query(host)
+	if err != nil {
+		if ok {
+			LogWarn("DNS Bootstrap: Refreshing %s failed, keeping %v: %v", host, pin.ips, err)
+			return pin.ips, nil
+		}
+		return nil, err
+	}
+	if ttl < minBootstrapTTL {
+		ttl = minBootstrapTTL
+	}
+	if ttl > maxBootstrapTTL {
+		ttl = maxBootstrapTTL
+	}
+	LogDebug("DNS Bootstrap: %s -> %s (pinned for %s)", host, strings.Join(ips, ", "), ttl)
+
+	b.mu.Lock()
+	b.pinned[host] = pinnedAddrs{ips: ips, expiresAt: time.Now().Add(ttl)}
+	b.mu.Unlock()
+	return ips, nil
+}
+
+// query asks the bootstrap servers for the A and AAAA records of host.
+func (b *bootstrapResolver) query(host string) ([]string, time.Duration, error) {
+	type result struct {
+		ips []string
+		ttl uint32
+		err error
+	}
+	qTypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make(chan result, len(qTypes))
+	for _, qType := range qTypes {
+		go func(qType uint16) {
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(host), qType)
+			m.RecursionDesired = true
+			reply, _, err := b.backend.Exchange(m)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			var res result
+			for _, ans := range reply.Answer {
+				switch rr := ans.(type) {
+				case *dns.A:
+					res.ips = append(res.ips, rr.A.String())
+				case *dns.AAAA:
+					res.ips = append(res.ips, rr.AAAA.String())
+				default:
+					continue
+				}
+				if res.ttl == 0 || ans.Header().Ttl < res.ttl {
+					res.ttl = ans.Header().Ttl
+				}
+			}
+			results <- res
+		}(qType)
+	}
+
+	var ips []string
+	var ttl uint32
+	var lastErr error
+	for range qTypes {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		ips = append(ips, res.ips...)
+		if len(res.ips) > 0 && (ttl == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no address for %s", host)
+		}
+		return nil, 0, lastErr
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// dialContext dials addr with its host resolved through the bootstrap
+// servers. It fits http.Transport.DialContext.
+func (b *bootstrapResolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := b.lookup(host)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap %s: %v", host, err)
+	}
+	targets := make([]string, len(ips))
+	for i, ip := range ips {
+		targets[i] = net.JoinHostPort(ip, port)
+	}
+	conn, _, err := dialTargets(ctx, targets)
+	return conn, err
+}
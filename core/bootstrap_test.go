@@ -0,0 +1,65 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type fakeUpstream struct {
+	calls atomic.Int32
+	fail  atomic.Bool
+}
+
+func (u *fakeUpstream) Address() string { return "fake" }
+func (u *fakeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.calls.Add(1)
+	if u.fail.Load() {
+		return nil, errors.New("unreachable")
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeA {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 5},
+			A:   net.ParseIP("192.0.2.53"),
+		})
+	}
+	return reply, nil
+}
+
+func TestBootstrapPinsAndKeepsAddresses(t *testing.T) {
+	up := &fakeUpstream{}
+	b := newBootstrapResolver(nil, time.Second)
+	b.backend = newStdBackend([]stdUpstream{up}, time.Second, dnsStrategyRace)
+
+	ips, err := b.lookup("dns.bootstrap-test.invalid")
+	if err != nil || len(ips) != 1 || ips[0] != "192.0.2.53" {
+		t.Fatalf("lookup: %v, %v", ips, err)
+	}
+	calls := up.calls.Load()
+	// Short TTLs are raised to minBootstrapTTL.
+	if _, err := b.lookup("dns.bootstrap-test.invalid"); err != nil || up.calls.Load() != calls {
+		t.Fatalf("pinned address not reused")
+	}
+
+	// An expired pin whose refresh fails is still used.
+	b.mu.Lock()
+	pin := b.pinned["dns.bootstrap-test.invalid"]
+	pin.expiresAt = time.Now().Add(-time.Second)
+	b.pinned["dns.bootstrap-test.invalid"] = pin
+	b.mu.Unlock()
+	up.fail.Store(true)
+	ips, err = b.lookup("dns.bootstrap-test.invalid")
+	if err != nil || len(ips) != 1 || up.calls.Load() == calls {
+		t.Fatalf("stale pin: %v, %v (calls %d)", ips, err, up.calls.Load())
+	}
+
+	if _, err := b.lookup("other.bootstrap-test.invalid"); err == nil {
+		t.Fatal("lookup succeeded with every bootstrap server down")
+	}
+}
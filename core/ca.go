@@ -1,6 +1,7 @@
 package core
 
 import (
+	"container/list"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -14,22 +15,50 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// maxLeafCacheSize bounds the number of cached leaf certificates.
+	maxLeafCacheSize = 256
+	leafValidity     = 24 * time.Hour
+	// leafRenewBefore is how long before expiry a cached leaf is replaced.
+	leafRenewBefore = 1 * time.Hour
 )
 
 // CertManager manages the Root CA and signs leaf certificates for proxying.
 type CertManager struct {
-	RootCert  *x509.Certificate
-	RootKey   interface{}
-	certCache sync.Map // map[string]*tls.Certificate
-	stopChan  chan struct{}
+	RootCert *x509.Certificate
+	RootKey  interface{}
+
+	leafKeyOnce sync.Once
+	leafKey     *ecdsa.PrivateKey
+	leafKeyErr  error
+
+	cacheMu   sync.Mutex
+	certCache map[string]*list.Element // cache key -> element holding *leafCacheEntry
+	certLRU   *list.List               // front is most recently used
+	signGroup singleflight.Group
+
+	stopChan chan struct{}
+}
+
+type leafCacheEntry struct {
+	key  string
+	cert *tls.Certificate
 }
 
 // NewCertManager creates a new CertManager, loading existing CA files or generating new ones.
 func NewCertManager(caCertPath, caKeyPath string) (*CertManager, error) {
 	cm := &CertManager{
-		stopChan: make(chan struct{}),
+		certCache: make(map[string]*list.Element),
+		certLRU:   list.New(),
+		stopChan:  make(chan struct{}),
 	}
 
 	// Try loading existing CA
@@ -205,10 +234,20 @@ func (cm *CertManager) saveCA(certPath, keyPath string) error {
 	return nil
 }
 
+// sharedLeafKey returns the key pair used for every leaf certificate,
+// generating it on first use. Sharing one key avoids a key generation per
+// MITM connection; leaf certs are only trusted through our own CA anyway.
+func (cm *CertManager) sharedLeafKey() (*ecdsa.PrivateKey, error) {
+	cm.leafKeyOnce.Do(func() {
+		// ECDSA is faster to sign with than RSA
+		cm.leafKey, cm.leafKeyErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	})
+	return cm.leafKey, cm.leafKeyErr
+}
+
 // SignLeafCert signs a new leaf certificate for the given hosts.
 func (cm *CertManager) SignLeafCert(hosts []string) ([]byte, interface{}, error) {
-	// Generate leaf key (ECDSA is faster)
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	priv, err := cm.sharedLeafKey()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -225,7 +264,7 @@ func (cm *CertManager) SignLeafCert(hosts []string) ([]byte, interface{}, error)
 			Organization: []string{"Snirect Proxy"},
 		},
 		NotBefore:   time.Now().Add(-1 * time.Hour),
-		NotAfter:    time.Now().Add(24 * time.Hour), // Short validity for leaf certs
+		NotAfter:    time.Now().Add(leafValidity), // Short validity for leaf certs
 		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		DNSNames:    hosts,
@@ -239,6 +278,87 @@ func (cm *CertManager) SignLeafCert(hosts []string) ([]byte, interface{}, error)
 	return derBytes, priv, nil
 }
 
+// GetLeafCert returns a ready-to-use certificate for hosts, signing and
+// caching one if needed. Concurrent callers for the same host set share a
+// single signing operation.
+func (cm *CertManager) GetLeafCert(hosts []string) (*tls.Certificate, error) {
+	key := leafCacheKey(hosts)
+	if cert := cm.cachedLeaf(key); cert != nil {
+		return cert, nil
+	}
+
+	v, err, _ := cm.signGroup.Do(key, func() (interface{}, error) {
+		if cert := cm.cachedLeaf(key); cert != nil {
+			return cert, nil
+		}
+		derBytes, priv, err := cm.SignLeafCert(hosts)
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := x509.ParseCertificate(derBytes)
+		if err != nil {
+			return nil, err
+		}
+		cert := &tls.Certificate{
+			Certificate: [][]byte{derBytes},
+			PrivateKey:  priv,
+			Leaf:        leaf,
+		}
+		cm.storeLeaf(key, cert)
+		LogDebug("CA: Signed leaf cert for %v", hosts)
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
+
+func leafCacheKey(hosts []string) string {
+	sorted := append([]string(nil), hosts...)
+	for i := range sorted {
+		sorted[i] = strings.ToLower(sorted[i])
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// cachedLeaf returns a cached certificate that is not close to expiry.
+func (cm *CertManager) cachedLeaf(key string) *tls.Certificate {
+	cm.cacheMu.Lock()
+	defer cm.cacheMu.Unlock()
+
+	elem, ok := cm.certCache[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*leafCacheEntry)
+	if time.Now().Add(leafRenewBefore).After(entry.cert.Leaf.NotAfter) {
+		cm.certLRU.Remove(elem)
+		delete(cm.certCache, key)
+		return nil
+	}
+	cm.certLRU.MoveToFront(elem)
+	return entry.cert
+}
+
+func (cm *CertManager) storeLeaf(key string, cert *tls.Certificate) {
+	cm.cacheMu.Lock()
+	defer cm.cacheMu.Unlock()
+
+	if elem, ok := cm.certCache[key]; ok {
+		elem.Value.(*leafCacheEntry).cert = cert
+		cm.certLRU.MoveToFront(elem)
+		return
+	}
+	cm.certCache[key] = cm.certLRU.PushFront(&leafCacheEntry{key: key, cert: cert})
+	for cm.certLRU.Len() > maxLeafCacheSize {
+		oldest := cm.certLRU.Back()
+		cm.certLRU.Remove(oldest)
+		delete(cm.certCache, oldest.Value.(*leafCacheEntry).key)
+	}
+}
+
 func (cm *CertManager) cleanupRoutine() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
@@ -248,18 +368,18 @@ func (cm *CertManager) cleanupRoutine() {
 		case <-cm.stopChan:
 			return
 		case <-ticker.C:
-			cm.certCache.Range(func(key, value interface{}) bool {
-				cert := value.(*tls.Certificate)
-				if len(cert.Certificate) > 0 {
-					x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-					if err == nil {
-						if time.Now().After(x509Cert.NotAfter) {
-							cm.certCache.Delete(key)
-						}
-					}
+			cm.cacheMu.Lock()
+			now := time.Now()
+			for elem := cm.certLRU.Front(); elem != nil; {
+				next := elem.Next()
+				entry := elem.Value.(*leafCacheEntry)
+				if now.After(entry.cert.Leaf.NotAfter) {
+					cm.certLRU.Remove(elem)
+					delete(cm.certCache, entry.key)
 				}
-				return true
-			})
+				elem = next
+			}
+			cm.cacheMu.Unlock()
 		}
 	}
 }
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestGetLeafCertCache(t *testing.T) {
+	dir := t.TempDir()
+	cm, err := NewCertManager(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatalf("NewCertManager: %v", err)
+	}
+	defer cm.Close()
+
+	var wg sync.WaitGroup
+	certs := make([]interface{}, 16)
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := cm.GetLeafCert([]string{"b.example.com", "A.example.com"})
+			if err != nil {
+				t.Errorf("GetLeafCert: %v", err)
+				return
+			}
+			certs[i] = cert
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range certs[1:] {
+		if c != certs[0] {
+			t.Fatalf("concurrent callers got different certificates")
+		}
+	}
+
+	again, err := cm.GetLeafCert([]string{"a.example.com", "b.example.com"})
+	if err != nil || interface{}(again) != certs[0] {
+		t.Fatalf("host set in different order missed the cache")
+	}
+	if err := again.Leaf.VerifyHostname("b.example.com"); err != nil {
+		t.Fatalf("leaf does not cover requested host: %v", err)
+	}
+
+	for i := 0; i < maxLeafCacheSize+10; i++ {
+		if _, err := cm.GetLeafCert([]string{fmt.Sprintf("h%d.example.com", i)}); err != nil {
+			t.Fatalf("GetLeafCert: %v", err)
+		}
+	}
+	if n := cm.certLRU.Len(); n != maxLeafCacheSize {
+		t.Fatalf("cache size = %d, want %d", n, maxLeafCacheSize)
+	}
+	if _, ok := cm.certCache["a.example.com,b.example.com"]; ok {
+		t.Fatalf("least recently used entry was not evicted")
+	}
+}
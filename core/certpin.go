@@ -0,0 +1,140 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// certPin is a cert_verify value naming a certificate instead of a host:
+// "sha256/<base64>" pins the SHA-256 of a SubjectPublicKeyInfo (as in
+// HPKP), and "sha256:<hex>" (colons optional) the SHA-256 fingerprint of a
+// whole certificate.
+type certPin struct {
+	spki bool
+	hash []byte
+}
+
+func parseCertPin(s string) (certPin, bool) {
+	if b64, ok := strings.CutPrefix(s, "sha256/"); ok {
+		hash, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(hash) != sha256.Size {
+			return certPin{}, false
+		}
+		return certPin{spki: true, hash: hash}, true
+	}
+	if h, ok := strings.CutPrefix(strings.ToLower(s), "sha256:"); ok {
+		hash, err := hex.DecodeString(strings.ReplaceAll(h, ":", ""))
+		if err != nil || len(hash) != sha256.Size {
+			return certPin{}, false
+		}
+		return certPin{hash: hash}, true
+	}
+	return certPin{}, false
+}
+
+func (p certPin) matches(cert *x509.Certificate) bool {
+	var sum [sha256.Size]byte
+	if p.spki {
+		sum = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	} else {
+		sum = sha256.Sum256(cert.Raw)
+	}
+	return bytes.Equal(sum[:], p.hash)
+}
+
+// verifyPinned accepts a chain whose leaf matches one of pins, or whose leaf
+// chains up to a presented certificate that does. Only the leaf proves
+// possession of its key, so a pinned intermediate or root has to be reached
+// by signatures rather than merely be present.
+func verifyPinned(certs []*x509.Certificate, pins []certPin) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no peer certificate")
+	}
+	for _, pin := range pins {
+		if pin.matches(certs[0]) {
+			return nil
+		}
+	}
+
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	pinned := false
+	for _, cert := range certs[1:] {
+		isPinned := false
+		for _, pin := range pins {
+			if pin.matches(cert) {
+				isPinned = true
+				break
+			}
+		}
+		if isPinned {
+			roots.AddCert(cert)
+			pinned = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("no certificate in the chain matches the pinned keys")
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// verifyCertEntries checks a peer chain against loose cert_verify entries:
+// it passes if the chain is valid for any of hosts or matches any of pins.
+func verifyCertEntries(certs []*x509.Certificate, hosts []string, pins []certPin) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no peer certificate")
+	}
+	var errs []string
+	if len(pins) > 0 {
+		err := verifyPinned(certs, pins)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	for _, host := range hosts {
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         trustedRoots(),
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("certificate verification failed: %s", strings.Join(errs, "; "))
+}
+
+// splitCertVerifyEntries sorts loose cert_verify values into host names and
+// pins.
+func splitCertVerifyEntries(entries []string) ([]string, []certPin) {
+	var hosts []string
+	var pins []certPin
+	for _, e := range entries {
+		if pin, ok := parseCertPin(e); ok {
+			pins = append(pins, pin)
+		} else if strings.HasPrefix(e, "sha256") {
+			LogWarn("TLS Client: Ignoring malformed pin %q", e)
+		} else if e != "" {
+			hosts = append(hosts, e)
+		}
+	}
+	return hosts, pins
+}
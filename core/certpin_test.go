@@ -0,0 +1,67 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testChain(t *testing.T, dir string) []*x509.Certificate {
+	t.Helper()
+	cm, err := NewCertManager(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatalf("NewCertManager: %v", err)
+	}
+	defer cm.Close()
+	der, _, err := cm.SignLeafCert([]string{"pinned.example.com"})
+	if err != nil {
+		t.Fatalf("SignLeafCert: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*x509.Certificate{leaf, cm.RootCert}
+}
+
+func spkiPin(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestVerifyCertEntries(t *testing.T) {
+	chain := testChain(t, t.TempDir())
+	other := testChain(t, t.TempDir())
+	leafFP := sha256.Sum256(chain[0].Raw)
+	colonFP := strings.ToUpper(hex.EncodeToString(leafFP[:]))
+	var withColons []string
+	for i := 0; i < len(colonFP); i += 2 {
+		withColons = append(withColons, colonFP[i:i+2])
+	}
+
+	for _, tc := range []struct {
+		name    string
+		entries []string
+		certs   []*x509.Certificate
+		ok      bool
+	}{
+		{"leaf spki", []string{spkiPin(chain[0])}, chain, true},
+		{"root spki", []string{spkiPin(chain[1])}, chain, true},
+		{"leaf fingerprint", []string{"sha256:" + strings.Join(withColons, ":")}, chain, true},
+		{"wrong pin", []string{spkiPin(other[0])}, chain, false},
+		// A pinned CA merely appended to the chain doesn't vouch for the leaf.
+		{"unrelated pinned root", []string{spkiPin(chain[1])}, []*x509.Certificate{other[0], chain[1]}, false},
+		{"host not trusted", []string{"pinned.example.com"}, chain, false},
+		{"malformed pin only", []string{"sha256/bogus"}, chain, false},
+	} {
+		hosts, pins := splitCertVerifyEntries(tc.entries)
+		err := verifyCertEntries(tc.certs, hosts, pins)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
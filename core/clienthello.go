@@ -0,0 +1,375 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	recordTypeHandshake  = 0x16
+	handshakeClientHello = 0x01
+
+	recordHeaderLen = 5
+	// RFC 8446 allows 2^14 bytes of plaintext per record; leave room for
+	// stacks that pad slightly past it.
+	maxRecordLen = 16384 + 2048
+	// Upper bound for a reassembled ClientHello. Post-quantum key shares,
+	// large tickets and padding stay well below this.
+	maxClientHelloLen = 64 * 1024
+)
+
+// readClientHello reads TLS records from conn until the first handshake
+// message is complete. It returns every byte consumed from conn (record
+// headers included) so the caller can replay them verbatim upstream, and the
+// reassembled handshake message itself. On error the bytes read so far are
+// still returned.
+func readClientHello(conn net.Conn) (raw []byte, hello []byte, err error) {
+	buf := make([]byte, 0, 4096)
+	var handshake []byte
+	pos := 0
+
+	// fill reads until at least n bytes are buffered.
+	fill := func(n int) error {
+		for len(buf) < n {
+			if cap(buf) == len(buf) {
+				grown := make([]byte, len(buf), max(2*cap(buf), n))
+				copy(grown, buf)
+				buf = grown
+			}
+			m, err := conn.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+m]
+			if err != nil {
+				if err == io.EOF && len(buf) >= n {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		if err := fill(pos + recordHeaderLen); err != nil {
+			return buf, nil, err
+		}
+		if buf[pos] != recordTypeHandshake || buf[pos+1] != 0x03 {
+			return buf, nil, fmt.Errorf("not a TLS handshake record (type %#x)", buf[pos])
+		}
+		recLen := int(binary.BigEndian.Uint16(buf[pos+3 : pos+5]))
+		if recLen == 0 || recLen > maxRecordLen {
+			return buf, nil, fmt.Errorf("invalid record length %d", recLen)
+		}
+		end := pos + recordHeaderLen + recLen
+		if end > maxClientHelloLen {
+			return buf, nil, fmt.Errorf("ClientHello exceeds %d bytes", maxClientHelloLen)
+		}
+		if err := fill(end); err != nil {
+			return buf, nil, err
+		}
+		handshake = append(handshake, buf[pos+recordHeaderLen:end]...)
+		pos = end
+
+		if len(handshake) < 4 {
+			continue
+		}
+		if handshake[0] != handshakeClientHello {
+			return buf, nil, fmt.Errorf("unexpected handshake type %d", handshake[0])
+		}
+		msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if msgLen > maxClientHelloLen {
+			return buf, nil, fmt.Errorf("ClientHello length %d exceeds limit", msgLen)
+		}
+		if len(handshake) >= 4+msgLen {
+			return buf, handshake[:4+msgLen], nil
+		}
+	}
+}
+
+// TLS extension types inspected by the ClientHello parser.
+const (
+	extServerName           = 0
+	extSupportedGroups      = 10
+	extALPN                 = 16
+	extPreSharedKey         = 41
+	extSupportedVersions    = 43
+	extKeyShare             = 51
+	extEncryptedClientHello = 0xfe0d
+)
+
+// tlsExtension is a raw extension as it appears in the ClientHello.
+type tlsExtension struct {
+	Type uint16
+	// Offset of the extension body relative to the start of the handshake message.
+	Offset int
+	Data   []byte
+}
+
+// clientHelloInfo is the decoded form of a ClientHello handshake message.
+type clientHelloInfo struct {
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+	ServerNames        []string
+	ALPN               []string
+	SupportedVersions  []uint16
+	SupportedGroups    []uint16
+	KeyShareGroups     []uint16
+	HasECH             bool
+	HasPSK             bool
+	Extensions         []tlsExtension
+
+	// raw is the handshake message the fields were parsed from.
+	raw []byte
+	// Position of the first host_name entry (the name bytes themselves)
+	// within the handshake message; sniOffset is -1 when absent.
+	sniOffset int
+	sniLen    int
+}
+
+// ServerName returns the first host_name from the server_name extension.
+func (ch *clientHelloInfo) ServerName() string {
+	if len(ch.ServerNames) == 0 {
+		return ""
+	}
+	return ch.ServerNames[0]
+}
+
+// helloReader is a bounds-checked cursor over a byte slice. Every read
+// reports failure instead of panicking so hostile input is safe to decode.
+type helloReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *helloReader) empty() bool { return r.pos >= len(r.data) }
+
+func (r *helloReader) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, false
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, true
+}
+
+func (r *helloReader) u8() (uint8, bool) {
+	b, ok := r.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (r *helloReader) u16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+func (r *helloReader) u24() (int, bool) {
+	b, ok := r.bytes(3)
+	if !ok {
+		return 0, false
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2]), true
+}
+
+// u8Prefixed and u16Prefixed return a sub-reader over a length-prefixed
+// vector. The sub-reader keeps absolute offsets of the parent.
+func (r *helloReader) u8Prefixed() (*helloReader, bool) {
+	n, ok := r.u8()
+	if !ok {
+		return nil, false
+	}
+	return r.sub(int(n))
+}
+
+func (r *helloReader) u16Prefixed() (*helloReader, bool) {
+	n, ok := r.u16()
+	if !ok {
+		return nil, false
+	}
+	return r.sub(int(n))
+}
+
+func (r *helloReader) sub(n int) (*helloReader, bool) {
+	start := r.pos
+	if _, ok := r.bytes(n); !ok {
+		return nil, false
+	}
+	return &helloReader{data: r.data[:start+n], pos: start}, true
+}
+
+// parseClientHello decodes a ClientHello handshake message (handshake header
+// included), as returned by readClientHello.
+func parseClientHello(hello []byte) (*clientHelloInfo, error) {
+	r := &helloReader{data: hello}
+	msgType, ok := r.u8()
+	if !ok || msgType != handshakeClientHello {
+		return nil, fmt.Errorf("not a ClientHello")
+	}
+	msgLen, ok := r.u24()
+	if !ok || msgLen > len(hello)-4 {
+		return nil, fmt.Errorf("truncated ClientHello")
+	}
+	r, _ = r.sub(msgLen)
+
+	ch := &clientHelloInfo{sniOffset: -1, raw: hello[:4+msgLen]}
+	if ch.Version, ok = r.u16(); !ok {
+		return nil, fmt.Errorf("short")
+	}
+	if ch.Random, ok = r.bytes(32); !ok {
+		return nil, fmt.Errorf("short")
+	}
+	sid, ok := r.u8Prefixed()
+	if !ok || len(sid.data)-sid.pos > 32 {
+		return nil, fmt.Errorf("invalid session id")
+	}
+	ch.SessionID = sid.data[sid.pos:]
+
+	suites, ok := r.u16Prefixed()
+	if !ok || (len(suites.data)-suites.pos)%2 != 0 {
+		return nil, fmt.Errorf("invalid cipher suites")
+	}
+	for !suites.empty() {
+		s, _ := suites.u16()
+		ch.CipherSuites = append(ch.CipherSuites, s)
+	}
+
+	comp, ok := r.u8Prefixed()
+	if !ok {
+		return nil, fmt.Errorf("invalid compression methods")
+	}
+	ch.CompressionMethods = comp.data[comp.pos:]
+
+	// Extensions are optional in pre-TLS 1.3 hellos.
+	if r.empty() {
+		return ch, nil
+	}
+	exts, ok := r.u16Prefixed()
+	if !ok {
+		return nil, fmt.Errorf("invalid extensions length")
+	}
+	for !exts.empty() {
+		extType, ok := exts.u16()
+		if !ok {
+			return nil, fmt.Errorf("truncated extension header")
+		}
+		body, ok := exts.u16Prefixed()
+		if !ok {
+			return nil, fmt.Errorf("truncated extension %d", extType)
+		}
+		ch.Extensions = append(ch.Extensions, tlsExtension{
+			Type:   extType,
+			Offset: body.pos,
+			Data:   body.data[body.pos:],
+		})
+		if err := ch.parseExtension(extType, body); err != nil {
+			return nil, err
+		}
+	}
+	return ch, nil
+}
+
+func (ch *clientHelloInfo) parseExtension(extType uint16, body *helloReader) error {
+	switch extType {
+	case extServerName:
+		list, ok := body.u16Prefixed()
+		if !ok {
+			return fmt.Errorf("invalid server_name extension")
+		}
+		for !list.empty() {
+			nameType, ok := list.u8()
+			if !ok {
+				return fmt.Errorf("invalid server_name entry")
+			}
+			name, ok := list.u16Prefixed()
+			if !ok {
+				return fmt.Errorf("invalid server_name entry")
+			}
+			if nameType != 0 {
+				continue
+			}
+			if ch.sniOffset < 0 {
+				ch.sniOffset = name.pos
+				ch.sniLen = len(name.data) - name.pos
+			}
+			ch.ServerNames = append(ch.ServerNames, string(name.data[name.pos:]))
+		}
+	case extALPN:
+		list, ok := body.u16Prefixed()
+		if !ok {
+			return fmt.Errorf("invalid ALPN extension")
+		}
+		for !list.empty() {
+			proto, ok := list.u8Prefixed()
+			if !ok {
+				return fmt.Errorf("invalid ALPN entry")
+			}
+			ch.ALPN = append(ch.ALPN, string(proto.data[proto.pos:]))
+		}
+	case extSupportedVersions:
+		list, ok := body.u8Prefixed()
+		if !ok || (len(list.data)-list.pos)%2 != 0 {
+			return fmt.Errorf("invalid supported_versions extension")
+		}
+		for !list.empty() {
+			v, _ := list.u16()
+			ch.SupportedVersions = append(ch.SupportedVersions, v)
+		}
+	case extSupportedGroups:
+		list, ok := body.u16Prefixed()
+		if !ok || (len(list.data)-list.pos)%2 != 0 {
+			return fmt.Errorf("invalid supported_groups extension")
+		}
+		for !list.empty() {
+			g, _ := list.u16()
+			ch.SupportedGroups = append(ch.SupportedGroups, g)
+		}
+	case extKeyShare:
+		list, ok := body.u16Prefixed()
+		if !ok {
+			return fmt.Errorf("invalid key_share extension")
+		}
+		for !list.empty() {
+			group, ok := list.u16()
+			if !ok {
+				return fmt.Errorf("invalid key_share entry")
+			}
+			if _, ok := list.u16Prefixed(); !ok {
+				return fmt.Errorf("invalid key_share entry")
+			}
+			ch.KeyShareGroups = append(ch.KeyShareGroups, group)
+		}
+	case extPreSharedKey:
+		ch.HasPSK = true
+	case extEncryptedClientHello:
+		ch.HasECH = true
+	}
+	return nil
+}
+
+// handshakeToRecordOffset maps an offset inside the reassembled handshake
+// message to the corresponding offset in the raw record stream, skipping
+// record headers. It returns -1 if off lies beyond the records in raw.
+func handshakeToRecordOffset(raw []byte, off int) int {
+	pos := 0
+	for pos+recordHeaderLen <= len(raw) {
+		recLen := int(binary.BigEndian.Uint16(raw[pos+3 : pos+5]))
+		if off < recLen {
+			if pos+recordHeaderLen+off >= len(raw) {
+				return -1
+			}
+			return pos + recordHeaderLen + off
+		}
+		off -= recLen
+		pos += recordHeaderLen + recLen
+	}
+	return -1
+}
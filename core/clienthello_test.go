@@ -0,0 +1,164 @@
+package core
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// captureClientHello returns the raw record bytes crypto/tls sends for a
+// ClientHello with the given server name and ALPN list.
+func captureClientHello(t testing.TB, serverName string, alpn []string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	raw, _, err := readClientHello(server)
+	if err != nil {
+		t.Fatalf("capture ClientHello: %v", err)
+	}
+	return raw
+}
+
+// refragment splits the handshake payload of a single-record ClientHello into
+// records carrying at most size bytes each.
+func refragment(raw []byte, size int) []byte {
+	payload := raw[recordHeaderLen:]
+	var out []byte
+	for len(payload) > 0 {
+		n := min(size, len(payload))
+		hdr := []byte{recordTypeHandshake, 0x03, 0x01, 0, 0}
+		binary.BigEndian.PutUint16(hdr[3:], uint16(n))
+		out = append(out, hdr...)
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+func TestReadClientHelloFragmented(t *testing.T) {
+	var alpn []string
+	for i := 0; i < 40; i++ {
+		alpn = append(alpn, strings.Repeat("x", 100))
+	}
+	raw := captureClientHello(t, "fragmented.example.com", alpn)
+	wire := refragment(raw, 64)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		// Write in small TCP-segment-like chunks that don't line up with records.
+		for off := 0; off < len(wire); off += 37 {
+			client.Write(wire[off:min(off+37, len(wire))])
+		}
+	}()
+
+	got, hello, err := readClientHello(server)
+	if err != nil {
+		t.Fatalf("readClientHello: %v", err)
+	}
+	if string(got[:len(wire)]) != string(wire) {
+		t.Fatalf("raw bytes not preserved for replay")
+	}
+	if string(hello) != string(raw[recordHeaderLen:]) {
+		t.Fatalf("reassembled handshake mismatch: got %d bytes, want %d", len(hello), len(raw)-recordHeaderLen)
+	}
+	ch, err := parseClientHello(hello)
+	if err != nil || ch.ServerName() != "fragmented.example.com" {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+	if len(ch.ALPN) != len(alpn) {
+		t.Fatalf("ALPN count = %d, want %d", len(ch.ALPN), len(alpn))
+	}
+
+	modified := tryModifySNI(got, hello, "fragmented.example.org")
+	if modified == nil {
+		t.Fatalf("tryModifySNI failed across records")
+	}
+	client2, server2 := net.Pipe()
+	defer server2.Close()
+	go client2.Write(modified)
+	_, hello2, err := readClientHello(server2)
+	if err != nil {
+		t.Fatalf("re-read modified hello: %v", err)
+	}
+	if ch2, err := parseClientHello(hello2); err != nil || ch2.ServerName() != "fragmented.example.org" {
+		t.Fatalf("modified SNI not applied: %v", err)
+	}
+}
+
+func TestReadClientHelloRejectsNonTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	raw, hello, err := readClientHello(server)
+	if err == nil || hello != nil {
+		t.Fatalf("expected error for plaintext, got hello=%v err=%v", hello, err)
+	}
+	if len(raw) == 0 {
+		t.Fatalf("consumed bytes must be returned for replay")
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	raw := captureClientHello(t, "www.example.com", []string{"h2", "http/1.1"})
+	ch, err := parseClientHello(raw[recordHeaderLen:])
+	if err != nil {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+	if ch.Version != tls.VersionTLS12 {
+		t.Errorf("legacy version = %#04x, want %#04x", ch.Version, tls.VersionTLS12)
+	}
+	if ch.ServerName() != "www.example.com" {
+		t.Errorf("ServerName = %q", ch.ServerName())
+	}
+	if strings.Join(ch.ALPN, ",") != "h2,http/1.1" {
+		t.Errorf("ALPN = %v", ch.ALPN)
+	}
+	if len(ch.CipherSuites) == 0 || len(ch.KeyShareGroups) == 0 {
+		t.Errorf("missing cipher suites or key shares: %v %v", ch.CipherSuites, ch.KeyShareGroups)
+	}
+	hasTLS13 := false
+	for _, v := range ch.SupportedVersions {
+		if v == tls.VersionTLS13 {
+			hasTLS13 = true
+		}
+	}
+	if !hasTLS13 {
+		t.Errorf("supported_versions = %x, want TLS 1.3", ch.SupportedVersions)
+	}
+	if ch.HasECH || ch.HasPSK {
+		t.Errorf("unexpected ECH/PSK flags: %v %v", ch.HasECH, ch.HasPSK)
+	}
+	if got := string(raw[recordHeaderLen+ch.sniOffset : recordHeaderLen+ch.sniOffset+ch.sniLen]); got != "www.example.com" {
+		t.Errorf("SNI offset points at %q", got)
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{handshakeClientHello, 0, 0, 0})
+	f.Add([]byte{handshakeClientHello, 0xff, 0xff, 0xff, 3, 3})
+	f.Add(captureClientHello(f, "a.example.com", []string{"h2"})[recordHeaderLen:])
+	f.Add(captureClientHello(f, "", nil)[recordHeaderLen:])
+	f.Fuzz(func(t *testing.T, hello []byte) {
+		ch, err := parseClientHello(hello)
+		if err != nil {
+			return
+		}
+		if ch.sniOffset >= 0 && ch.sniOffset+ch.sniLen > len(hello) {
+			t.Fatalf("SNI offset %d+%d out of range %d", ch.sniOffset, ch.sniLen, len(hello))
+		}
+		for _, ext := range ch.Extensions {
+			if ext.Offset+len(ext.Data) > len(hello) {
+				t.Fatalf("extension %d out of range", ext.Type)
+			}
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// happyEyeballsDelay is the RFC 8305 "Connection Attempt Delay": how long
+	// an attempt may run before the next address is tried alongside it.
+	happyEyeballsDelay = 250 * time.Millisecond
+
+	// Addresses that fail to connect are skipped for a cooldown that doubles
+	// with each consecutive failure.
+	addrCooldownBase = 30 * time.Second
+	addrCooldownMax  = 10 * time.Minute
+	maxAddrFailures  = 1024
+)
+
+type addrFailure struct {
+	count int
+	until time.Time
+}
+
+var addrHealth = struct {
+	sync.Mutex
+	failures map[string]*addrFailure
+}{failures: make(map[string]*addrFailure)}
+
+func markAddrFailed(addr string) {
+	addrHealth.Lock()
+	defer addrHealth.Unlock()
+
+	now := time.Now()
+	if len(addrHealth.failures) >= maxAddrFailures {
+		for a, f := range addrHealth.failures {
+			if now.After(f.until) {
+				delete(addrHealth.failures, a)
+			}
+		}
+	}
+
+	f := addrHealth.failures[addr]
+	if f == nil {
+		if len(addrHealth.failures) >= maxAddrFailures {
+			return
+		}
+		f = &addrFailure{}
+		addrHealth.failures[addr] = f
+	}
+	f.count++
+	cooldown := addrCooldownBase << min(f.count-1, 5)
+	if cooldown > addrCooldownMax {
+		cooldown = addrCooldownMax
+	}
+	f.until = now.Add(cooldown)
+}
+
+func markAddrOK(addr string) {
+	addrHealth.Lock()
+	delete(addrHealth.failures, addr)
+	addrHealth.Unlock()
+}
+
+func addrCoolingDown(addr string) bool {
+	addrHealth.Lock()
+	defer addrHealth.Unlock()
+	f := addrHealth.failures[addr]
+	return f != nil && time.Now().Before(f.until)
+}
+
+// splitTargetIPs splits a target_ip value, which may list several addresses
+// or host names separated by commas or spaces.
+func splitTargetIPs(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// resolveTargetIPs expands a target_ip value into IP addresses, resolving
+// host name entries through the trusted Resolver, and ranks them by the
+// latest front IP health checks.
+func resolveTargetIPs(ctx context.Context, targetIP string) []string {
+	globalEngine.mu.RLock()
+	resolver := globalEngine.resolver
+	globalEngine.mu.RUnlock()
+
+	var ips []string
+	for _, entry := range splitTargetIPs(targetIP) {
+		if net.ParseIP(entry) != nil {
+			ips = append(ips, entry)
+			continue
+		}
+		if resolver == nil {
+			LogWarn("Cannot resolve target '%s': no resolver", entry)
+			continue
+		}
+		resolved, err := resolver.ResolveAll(ctx, entry)
+		if err != nil {
+			LogWarn("Failed to resolve target '%s': %v", entry, err)
+			continue
+		}
+		ips = append(ips, resolved...)
+	}
+	return rankTargetIPs(ips)
+}
+
+// orderDialAddrs sorts addrs for Happy Eyeballs: addresses in cooldown are
+// dropped (unless that would leave none), and the rest alternate between
+// address families starting with the family of the first one (RFC 8305
+// section 4).
+func orderDialAddrs(addrs []string) []string {
+	var unique, healthy []string
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		unique = append(unique, a)
+		if !addrCoolingDown(a) {
+			healthy = append(healthy, a)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = unique
+		LogDebug("Dial: All of %v are cooling down, trying them anyway", unique)
+	}
+
+	var v4, v6 []string
+	for _, a := range healthy {
+		host, _, err := net.SplitHostPort(a)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.To4() == nil {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	first, second := v4, v6
+	if len(v6) > 0 && healthy[0] == v6[0] {
+		first, second = v6, v4
+	}
+	ordered := make([]string, 0, len(healthy))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialTargets connects to the first of addrs that answers, racing them
+// RFC 8305-style: a new attempt starts every happyEyeballsDelay, or as soon
+// as the previous one fails. It returns the connection and the address used.
+func dialTargets(ctx context.Context, addrs []string) (net.Conn, string, error) {
+	if len(addrs) == 0 {
+		return nil, "", fmt.Errorf("no addresses to dial")
+	}
+	if len(addrs) == 1 {
+		conn, err := getProtectedDialer().DialContext(ctx, "tcp", addrs[0])
+		return conn, addrs[0], err
+	}
+
+	ordered := orderDialAddrs(addrs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+	results := make(chan result, len(ordered))
+	dialer := getProtectedDialer()
+	attempt := func(addr string) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		results <- result{conn, addr, err}
+	}
+
+	var errs []error
+	next, pending := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ordered) {
+				go attempt(ordered[next])
+				next++
+				pending++
+				timer.Reset(happyEyeballsDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				markAddrOK(r.addr)
+				cancel()
+				// Close connections from attempts that finish after the winner.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				if len(errs) > 0 {
+					LogDebug("Dial: Connected to %s after %d failed attempts", r.addr, len(errs))
+				}
+				return r.conn, r.addr, nil
+			}
+			if ctx.Err() == nil {
+				LogDebug("Dial: %s failed: %v", r.addr, r.err)
+				markAddrFailed(r.addr)
+			}
+			errs = append(errs, r.err)
+			if next < len(ordered) {
+				// Don't wait out the delay after a failure.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, "", errors.Join(errs...)
+			}
+		}
+	}
+}
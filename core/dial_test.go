@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestOrderDialAddrs(t *testing.T) {
+	addrs := []string{"[2001:db8::1]:443", "[2001:db8::2]:443", "192.0.2.1:443", "192.0.2.2:443", "192.0.2.1:443"}
+	want := []string{"[2001:db8::1]:443", "192.0.2.1:443", "[2001:db8::2]:443", "192.0.2.2:443"}
+	if got := orderDialAddrs(addrs); !reflect.DeepEqual(got, want) {
+		t.Fatalf("orderDialAddrs = %v, want %v", got, want)
+	}
+
+	markAddrFailed("192.0.2.1:443")
+	defer markAddrOK("192.0.2.1:443")
+	want = []string{"[2001:db8::1]:443", "192.0.2.2:443", "[2001:db8::2]:443"}
+	if got := orderDialAddrs(addrs); !reflect.DeepEqual(got, want) {
+		t.Fatalf("with cooldown: orderDialAddrs = %v, want %v", got, want)
+	}
+	if got := orderDialAddrs([]string{"192.0.2.1:443"}); len(got) != 1 {
+		t.Fatalf("sole address in cooldown was dropped: %v", got)
+	}
+}
+
+func TestDialTargetsSkipsDeadAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Grab a port nobody listens on.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	defer markAddrOK(deadAddr)
+
+	conn, addr, err := dialTargets(context.Background(), []string{deadAddr, ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if addr != ln.Addr().String() {
+		t.Fatalf("connected to %s, want %s", addr, ln.Addr())
+	}
+	if !addrCoolingDown(deadAddr) {
+		t.Fatalf("refused address %s not put in cooldown", deadAddr)
+	}
+
+	if got := splitTargetIPs("192.0.2.1, 192.0.2.2 front.example.com"); len(got) != 3 {
+		t.Fatalf("splitTargetIPs = %v", got)
+	}
+}
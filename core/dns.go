@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,17 +11,31 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	// A DNS session from the TUN, a TCP connection or a UDP flow, is closed
+	// after this long without a query, and answers at most dnsMaxInflight
+	// queries at once.
+	dnsSessionIdle = 30 * time.Second
+	dnsMaxInflight = 16
+	// Replies to UDP queries without EDNS0 must fit in this many bytes.
+	dnsMinUDPSize = 512
+)
+
+// errNoDNSBackend means the Resolver has no upstreams to ask.
+var errNoDNSBackend = errors.New("no DNS backend")
+
 type dnsBackend interface {
 	Exchange(m *dns.Msg) (*dns.Msg, string, error)
 }
 
 type cacheEntry struct {
-	ip        string
+	ips       []string
 	expiresAt time.Time
 }
 
@@ -29,14 +44,17 @@ type Resolver struct {
 	backend dnsBackend
 	cache   map[string]cacheEntry
 	cacheMu sync.RWMutex
-	cb      EngineCallbacks
+	// msgCache holds the answers to queries from apps.
+	msgCache *msgCache
+	cb       EngineCallbacks
 }
 
 func NewResolver(cfg *Config, cb EngineCallbacks) *Resolver {
 	r := &Resolver{
-		config: cfg,
-		cache:  make(map[string]cacheEntry),
-		cb:     cb,
+		config:   cfg,
+		cache:    make(map[string]cacheEntry),
+		msgCache: newMsgCache(cfg.DNSCacheSize, cfg.ServeStale),
+		cb:       cb,
 	}
 	r.backend = newBackend(cfg)
 	go r.cleanCacheRoutine()
@@ -44,84 +62,174 @@ func NewResolver(cfg *Config, cb EngineCallbacks) *Resolver {
 }
 
 func (r *Resolver) Resolve(ctx context.Context, host string) (string, error) {
+	ips, err := r.ResolveAll(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// ResolveAll returns every address the trusted upstreams give for host, with
+// hosts rules taking precedence. AAAA answers are only included, ahead of
+// the A answers, when IPv6 is enabled. If the upstreams fail, the system
+// resolver is asked instead.
+func (r *Resolver) ResolveAll(ctx context.Context, host string) ([]string, error) {
+	ips, err := r.resolveTrusted(ctx, host)
+	if err == errNoDNSBackend {
+		LogDebug("No DNS backend, using system resolver for %s", host)
+		return r.resolveSystem(ctx, host)
+	}
+	if err != nil {
+		LogWarn("Remote DNS failed for %s, falling back to system: %v", host, err)
+		return r.resolveSystem(ctx, host)
+	}
+	return ips, nil
+}
+
+// resolveTrusted is ResolveAll without the system fallback: only hosts rules
+// and the configured upstreams are consulted.
+func (r *Resolver) resolveTrusted(ctx context.Context, host string) ([]string, error) {
 	if net.ParseIP(host) != nil {
-		return host, nil
+		return []string{host}, nil
 	}
 
 	LogDebug("Resolving host: %s", host)
 
-	globalEngine.mu.RLock()
-	rules := globalEngine.rules
-	globalEngine.mu.RUnlock()
-	if ip, ok := rules.GetHost(host); ok && net.ParseIP(ip) != nil {
-		LogDebug("DNS Rule Match: %s -> %s", host, ip)
-		return ip, nil
+	if policy := globalEngine.Match(host); policy != nil && policy.TargetIP != nil {
+		if ips := literalTargetIPs(*policy.TargetIP); len(ips) > 0 {
+			LogDebug("DNS Rule Match: %s -> %v (%s)", host, ips, policy.IPPattern)
+			return ips, nil
+		}
 	}
 
-	if ip, ok := r.getCache(host, dns.TypeA); ok {
-		LogDebug("DNS Cache Hit: %s -> %s", host, ip)
-		return ip, nil
+	if r.backend == nil {
+		return nil, errNoDNSBackend
 	}
 
-	if r.backend == nil {
-		LogDebug("No DNS backend, using system resolver for %s", host)
-		return r.resolveSystem(ctx, host)
+	qTypes := []uint16{dns.TypeA}
+	if r.ipv6Enabled() {
+		qTypes = []uint16{dns.TypeAAAA, dns.TypeA}
 	}
 
-	ip, err := r.resolveRemote(ctx, host)
+	type lookupResult struct {
+		ips []string
+		err error
+	}
+	results := make([]lookupResult, len(qTypes))
+	var wg sync.WaitGroup
+	for i, qType := range qTypes {
+		wg.Add(1)
+		go func(i int, qType uint16) {
+			defer wg.Done()
+			if ips, ok := r.getCache(host, qType); ok {
+				LogDebug("DNS Cache Hit: %s %s -> %v", host, dns.TypeToString[qType], ips)
+				results[i] = lookupResult{ips: ips}
+				return
+			}
+			ips, err := r.resolveRemote(ctx, host, qType)
+			results[i] = lookupResult{ips, err}
+		}(i, qType)
+	}
+	wg.Wait()
+
+	var ips []string
+	var err error
+	for _, res := range results {
+		ips = append(ips, res.ips...)
+		if res.err != nil {
+			err = res.err
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
 	if err == nil {
-		return ip, nil
+		err = fmt.Errorf("no address records")
 	}
+	return nil, err
+}
 
-	LogWarn("Remote DNS failed for %s, falling back to system: %v", host, err)
-	return r.resolveSystem(ctx, host)
+func (r *Resolver) ipv6Enabled() bool {
+	return r.config != nil && r.config.EnableIPv6
 }
 
-func (r *Resolver) resolveRemote(ctx context.Context, host string) (string, error) {
+// resolveRemote queries the backend for one address type. A successful
+// reply without matching records yields an empty list, which is cached
+// briefly so v4-only hosts don't trigger an AAAA query every time.
+func (r *Resolver) resolveRemote(ctx context.Context, host string, qType uint16) ([]string, error) {
 	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	m.SetQuestion(dns.Fqdn(host), qType)
 	m.RecursionDesired = true
 
 	reply, addr, err := r.backend.Exchange(m)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if reply.Rcode != dns.RcodeSuccess {
-		return "", fmt.Errorf("dns error: %s", dns.RcodeToString[reply.Rcode])
+		return nil, fmt.Errorf("dns error: %s", dns.RcodeToString[reply.Rcode])
 	}
 
+	var ips []string
+	var ttl uint32
 	for _, ans := range reply.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			ip := a.A.String()
-			r.setCache(host, ip, dns.TypeA, a.Hdr.Ttl)
-			LogInfo("DNS: %s -> %s (%s)", host, ip, addr)
-			return ip, nil
+		var ip net.IP
+		switch rr := ans.(type) {
+		case *dns.A:
+			if qType == dns.TypeA {
+				ip = rr.A
+			}
+		case *dns.AAAA:
+			if qType == dns.TypeAAAA {
+				ip = rr.AAAA
+			}
+		}
+		if ip == nil {
+			continue
 		}
+		if len(ips) == 0 || ans.Header().Ttl < ttl {
+			ttl = ans.Header().Ttl
+		}
+		ips = append(ips, ip.String())
+	}
+	if len(ips) == 0 {
+		r.setCache(host, nil, qType, 60)
+		return nil, nil
 	}
 
-	return "", fmt.Errorf("no A record")
+	r.setCache(host, ips, qType, ttl)
+	LogInfo("DNS: %s %s -> %v (%s)", host, dns.TypeToString[qType], ips, addr)
+	return ips, nil
 }
 
-func (r *Resolver) resolveSystem(ctx context.Context, host string) (string, error) {
-	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+func (r *Resolver) resolveSystem(ctx context.Context, host string) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return ips[0], nil
+	var ips []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && (ip.To4() != nil || r.ipv6Enabled()) {
+			ips = append(ips, addr)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable address for %s", host)
+	}
+	return ips, nil
 }
 
-func (r *Resolver) getCache(host string, qType uint16) (string, bool) {
+func (r *Resolver) getCache(host string, qType uint16) ([]string, bool) {
 	r.cacheMu.RLock()
 	defer r.cacheMu.RUnlock()
 	key := fmt.Sprintf("%s:%d", host, qType)
 	if entry, ok := r.cache[key]; ok && time.Now().Before(entry.expiresAt) {
-		return entry.ip, true
+		return entry.ips, true
 	}
-	return "", false
+	return nil, false
 }
 
-func (r *Resolver) setCache(host, ip string, qType uint16, ttl uint32) {
+func (r *Resolver) setCache(host string, ips []string, qType uint16, ttl uint32) {
 	if ttl == 0 {
 		ttl = 300
 	}
@@ -132,7 +240,7 @@ func (r *Resolver) setCache(host, ip string, qType uint16, ttl uint32) {
 	defer r.cacheMu.Unlock()
 	key := fmt.Sprintf("%s:%d", host, qType)
 	r.cache[key] = cacheEntry{
-		ip:        ip,
+		ips:       ips,
 		expiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
 	}
 }
@@ -148,12 +256,19 @@ func (r *Resolver) cleanCacheRoutine() {
 			}
 		}
 		r.cacheMu.Unlock()
+		r.msgCache.prune()
 	}
 }
 
 type stdBackend struct {
 	upstreams []stdUpstream
 	timeout   time.Duration
+	// strategy picks how upstreams are asked: all at once ("race"), in
+	// order ("failover"), starting from the next one each time
+	// ("round_robin"), or by measured response time ("fastest").
+	strategy string
+	stats    []*upstreamStats
+	next     atomic.Uint32
 }
 
 type stdUpstream interface {
@@ -162,6 +277,13 @@ type stdUpstream interface {
 }
 
 func (b *stdBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	if len(b.upstreams) == 0 {
+		return nil, "", fmt.Errorf("no nameservers")
+	}
+	if b.strategy != dnsStrategyRace {
+		return b.exchangeOrdered(m)
+	}
+
 	type result struct {
 		reply *dns.Msg
 		addr  string
@@ -169,14 +291,15 @@ func (b *stdBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
 	}
 	resCh := make(chan result, len(b.upstreams))
 
-	for _, u := range b.upstreams {
-		go func(u stdUpstream) {
-			reply, err := u.Exchange(m)
+	for i, u := range b.upstreams {
+		go func(i int, u stdUpstream) {
+			reply, err := b.exchangeOne(i, m)
 			resCh <- result{reply, u.Address(), err}
-		}(u)
+		}(i, u)
 	}
 
 	var lastErr error
+	timeout := time.After(b.timeout)
 	for i := 0; i < len(b.upstreams); i++ {
 		select {
 		case res := <-resCh:
@@ -184,7 +307,7 @@ func (b *stdBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
 				return res.reply, res.addr, nil
 			}
 			lastErr = res.err
-		case <-time.After(b.timeout):
+		case <-timeout:
 			if lastErr != nil {
 				return nil, "", lastErr
 			}
@@ -194,42 +317,41 @@ func (b *stdBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
 	return nil, "", lastErr
 }
 
+// newBackend builds the pool of NameServers that answer every query. The
+// BootstrapDNS servers only resolve the host names of encrypted
+// nameservers; they answer queries themselves only when no nameserver is
+// configured.
 func newBackend(cfg *Config) dnsBackend {
 	timeout := 5 * time.Second
-	var upstreams []stdUpstream
-
-	for _, bDns := range cfg.BootstrapDNS {
-		if bDns != "" {
-			u, err := parseUpstream(bDns, timeout)
-			if err == nil {
-				upstreams = append(upstreams, u)
-			}
-		}
-	}
-	if len(upstreams) == 0 {
-		u, _ := parseUpstream("223.5.5.5:53", timeout)
-		upstreams = append(upstreams, u)
-	}
+	boot := newBootstrapResolver(cfg.BootstrapDNS, timeout)
 
+	var upstreams []stdUpstream
 	for _, ns := range cfg.NameServers {
-		u, err := parseUpstream(ns, timeout)
+		u, err := parseUpstream(ns, timeout, boot)
 		if err == nil {
 			upstreams = append(upstreams, u)
 		}
 	}
-	return &stdBackend{upstreams: upstreams, timeout: timeout}
+	if len(upstreams) == 0 {
+		LogWarn("DNS: No nameservers configured, querying the bootstrap servers")
+		upstreams = boot.backend.upstreams
+	}
+	return newStdBackend(upstreams, timeout, cfg.DNSStrategy)
 }
 
-func parseUpstream(addr string, timeout time.Duration) (stdUpstream, error) {
+// parseUpstream parses a nameserver address. Host names of DoH and DoT
+// servers are resolved through boot when it is set, and the system
+// resolver otherwise.
+func parseUpstream(addr string, timeout time.Duration, boot *bootstrapResolver) (stdUpstream, error) {
 	if strings.HasPrefix(addr, "https://") {
-		return &dohUpstream{addr: addr, client: &http.Client{Timeout: timeout}}, nil
+		return &dohUpstream{addr: addr, client: &http.Client{Timeout: timeout}, boot: boot}, nil
 	}
 	if strings.HasPrefix(addr, "tls://") {
 		host := strings.TrimPrefix(addr, "tls://")
 		if !strings.Contains(host, ":") {
 			host += ":853"
 		}
-		return &dnsUpstream{addr: host, network: "tcp-tls", timeout: timeout}, nil
+		return &dnsUpstream{addr: host, network: "tcp-tls", timeout: timeout, boot: boot}, nil
 	}
 	// Default to UDP
 	host := addr
@@ -243,6 +365,7 @@ type dnsUpstream struct {
 	addr    string
 	network string
 	timeout time.Duration
+	boot    *bootstrapResolver
 }
 
 func (u *dnsUpstream) Address() string { return u.addr }
@@ -253,24 +376,76 @@ func (u *dnsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 		Dialer:  getProtectedDialer(),
 	}
 	if u.network == "tcp-tls" {
-		client.TLSConfig = &tls.Config{InsecureSkipVerify: false}
+		client.TLSConfig = &tls.Config{RootCAs: trustedRoots()}
+		if host, _, err := net.SplitHostPort(u.addr); err == nil && net.ParseIP(host) == nil && u.boot != nil {
+			return u.exchangeBootstrapped(client, host, m)
+		}
 	}
 	reply, _, err := client.Exchange(m, u.addr)
+	if err == nil && reply.Truncated && u.network == "udp" {
+		// The answer didn't fit in a datagram; ask again over TCP.
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(m, u.addr)
+	}
+	return reply, err
+}
+
+// exchangeBootstrapped runs a DoT exchange with the server's address from
+// the bootstrap servers instead of the system resolver.
+func (u *dnsUpstream) exchangeBootstrapped(client *dns.Client, host string, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	raw, err := u.boot.dialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := client.TLSConfig.Clone()
+	cfg.ServerName = host
+	conn := tls.Client(raw, cfg)
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	reply, _, err := client.ExchangeWithConn(m, &dns.Conn{Conn: conn})
 	return reply, err
 }
 
 type dohUpstream struct {
 	addr   string
 	client *http.Client
+	boot   *bootstrapResolver
+
+	mu       sync.Mutex
+	trustGen int // trust store generation the transport was built for
 }
 
 func (u *dohUpstream) Address() string { return u.addr }
 func (u *dohUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	if u.client.Transport == nil {
-		u.client.Transport = &http.Transport{
-			DialContext: getProtectedDialer().DialContext,
+	u.mu.Lock()
+	roots := trustedRoots()
+	if gen := trustGeneration(); u.client.Transport == nil || u.trustGen != gen {
+		if old, ok := u.client.Transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+		dial := getProtectedDialer().DialContext
+		if u.boot != nil {
+			dial = u.boot.dialContext
 		}
+		u.client = &http.Client{
+			Timeout: u.client.Timeout,
+			Transport: &http.Transport{
+				DialContext:     dial,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+		u.trustGen = gen
 	}
+	client := u.client
+	u.mu.Unlock()
+
 	data, err := m.Pack()
 	if err != nil {
 		return nil, err
@@ -282,7 +457,7 @@ func (u *dohUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	req.Header.Set("Content-Type", "application/dns-message")
 	req.Header.Set("Accept", "application/dns-message")
 
-	resp, err := u.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -302,6 +477,11 @@ func (u *dohUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	return reply, err
 }
 
+// handleDNSConnection serves one UDP flow from the TUN. Clients often send
+// several queries from the same port, so the flow is kept open until it
+// goes idle, with the queries answered concurrently. Replies are truncated
+// (with TC set) to the size the client advertised in EDNS0, so it retries
+// over TCP.
 func handleDNSConnection(conn net.Conn, cb EngineCallbacks) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -310,19 +490,132 @@ func handleDNSConnection(conn net.Conn, cb EngineCallbacks) {
 		conn.Close()
 	}()
 
-	buf := make([]byte, 2048)
-	n, err := conn.Read(buf)
-	if err != nil {
-		LogDebug("DNS Connection Read Error: %v", err)
-		return
+	var wg sync.WaitGroup
+	inflight := make(chan struct{}, dnsMaxInflight)
+	defer wg.Wait()
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsSessionIdle))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !isTimeout(err) {
+				LogDebug("DNS Connection Read Error: %v", err)
+			}
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			LogWarn("DNS Unpack Error: %v", err)
+			continue
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			reply := answerDNSQuery(msg)
+			if reply == nil {
+				return
+			}
+			reply.Truncate(dnsUDPSize(msg))
+			replyData, err := reply.Pack()
+			if err != nil {
+				LogError("DNS Pack Error: %v", err)
+				return
+			}
+			conn.Write(replyData)
+		}()
 	}
+}
 
-	msg := new(dns.Msg)
-	if err := msg.Unpack(buf[:n]); err != nil {
-		LogWarn("DNS Unpack Error: %v", err)
-		return
+// dnsUDPSize is the largest UDP reply the sender of msg accepts.
+func dnsUDPSize(msg *dns.Msg) int {
+	if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() > dnsMinUDPSize {
+		return int(opt.UDPSize())
 	}
+	return dnsMinUDPSize
+}
 
+// handleDNSTCPConnection serves DNS over a TCP connection from the TUN:
+// length-prefixed messages, answered concurrently and written back as they
+// complete (RFC 7766 pipelining), until the client closes or goes idle.
+func handleDNSTCPConnection(conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			LogError("PANIC in handleDNSTCPConnection: %v", r)
+		}
+		conn.Close()
+	}()
+
+	var (
+		writeMu sync.Mutex
+		wg      sync.WaitGroup
+	)
+	inflight := make(chan struct{}, dnsMaxInflight)
+	defer wg.Wait()
+
+	var lenBuf [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsSessionIdle))
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			if err != io.EOF {
+				LogDebug("DNS TCP: Read error: %v", err)
+			}
+			return
+		}
+		msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+		data := make([]byte, msgLen)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			LogDebug("DNS TCP: Truncated message: %v", err)
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(data); err != nil {
+			LogWarn("DNS TCP: Unpack Error: %v", err)
+			return
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			reply := answerDNSQuery(msg)
+			if reply == nil {
+				return
+			}
+			replyData, err := reply.Pack()
+			if err != nil {
+				LogError("DNS TCP: Pack Error: %v", err)
+				return
+			}
+			frame := make([]byte, 2+len(replyData))
+			frame[0] = byte(len(replyData) >> 8)
+			frame[1] = byte(len(replyData))
+			copy(frame[2:], replyData)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(dnsSessionIdle))
+			if _, err := conn.Write(frame); err != nil {
+				LogDebug("DNS TCP: Write error: %v", err)
+			}
+		}()
+	}
+}
+
+// answerDNSQuery answers a query from the TUN, whichever transport it came
+// in on: AAAA blocking, hosts and target_ip hijacks, and otherwise the
+// trusted upstreams. It returns nil when there is nothing to send back.
+func answerDNSQuery(msg *dns.Msg) *dns.Msg {
 	if len(msg.Question) > 0 {
 		qName := strings.TrimSuffix(msg.Question[0].Name, ".")
 		qType := msg.Question[0].Qtype
@@ -330,40 +623,36 @@ func handleDNSConnection(conn net.Conn, cb EngineCallbacks) {
 
 		globalEngine.mu.RLock()
 		cfg := globalEngine.config
-		rules := globalEngine.rules
 		globalEngine.mu.RUnlock()
 
 		if cfg != nil && !cfg.EnableIPv6 && qType == dns.TypeAAAA {
 			LogInfo("DNS: Blocking AAAA query for %s (IPv6 disabled)", qName)
-			reply := new(dns.Msg)
-			reply.SetReply(msg)
-			replyData, _ := reply.Pack()
-			conn.Write(replyData)
-			return
+			return localDNSReply(msg)
 		}
 
-		if ip, ok := rules.GetHost(qName); ok && net.ParseIP(ip) != nil {
-			if qType == dns.TypeA {
-				LogInfo("DNS Hijack: %s -> %s (Rule Match)", qName, ip)
-				reply := new(dns.Msg)
-				reply.SetReply(msg)
-
-				targetIP := ip
-				rr, err := dns.NewRR(fmt.Sprintf("%s 3600 IN A %s", msg.Question[0].Name, targetIP))
-				if err == nil {
-					reply.Answer = append(reply.Answer, rr)
-					replyData, _ := reply.Pack()
-					conn.Write(replyData)
-					return
+		policy := globalEngine.Match(qName)
+		if policy != nil && policy.TargetIP != nil && (qType == dns.TypeA || qType == dns.TypeAAAA) {
+			if ips := literalTargetIPs(*policy.TargetIP); len(ips) > 0 {
+				reply := localDNSReply(msg)
+
+				var answered []string
+				for _, entry := range ips {
+					ip := net.ParseIP(entry)
+					if isV4 := ip.To4() != nil; isV4 != (qType == dns.TypeA) {
+						continue
+					}
+					if rr, err := dns.NewRR(fmt.Sprintf("%s 3600 IN %s %s", msg.Question[0].Name, dns.TypeToString[qType], ip)); err == nil {
+						reply.Answer = append(reply.Answer, rr)
+						answered = append(answered, entry)
+					}
 				}
-			} else if qType == dns.TypeAAAA {
-				// Return empty success for AAAA if we hijack A, to avoid IPv6 issues
-				LogInfo("DNS Hijack (AAAA): %s -> EMPTY (Rule Match)", qName)
-				reply := new(dns.Msg)
-				reply.SetReply(msg)
-				replyData, _ := reply.Pack()
-				conn.Write(replyData)
-				return
+				if len(answered) > 0 {
+					LogInfo("DNS Hijack (%s): %s -> %s (Rule Match: %s)", dns.TypeToString[qType], qName, strings.Join(answered, ", "), policy.IPPattern)
+				} else {
+					// Answer the other family empty so the client only uses the rule's addresses
+					LogInfo("DNS Hijack (%s): %s -> EMPTY (Rule Match: %s)", dns.TypeToString[qType], qName, policy.IPPattern)
+				}
+				return reply
 			}
 		}
 	}
@@ -374,19 +663,36 @@ func handleDNSConnection(conn net.Conn, cb EngineCallbacks) {
 
 	if resolver == nil || resolver.backend == nil {
 		LogWarn("DNS Resolver or backend not initialized")
-		return
+		return nil
 	}
 
-	reply, _, err := resolver.backend.Exchange(msg)
+	reply, err := resolver.Exchange(msg)
 	if err != nil {
 		LogError("DNS Exchange Error: %v", err)
-		return
+		return nil
 	}
+	return reply
+}
 
-	replyData, err := reply.Pack()
-	if err == nil {
-		conn.Write(replyData)
-	} else {
-		LogError("DNS Pack Error: %v", err)
+// localDNSReply starts a reply generated here rather than upstream, with an
+// OPT record if the query had one.
+func localDNSReply(msg *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	if opt := msg.IsEdns0(); opt != nil {
+		reply.SetEdns0(uint16(dnsUDPSize(msg)), opt.Do())
+	}
+	return reply
+}
+
+// literalTargetIPs returns the IP address entries of a target_ip value,
+// skipping host names.
+func literalTargetIPs(targetIP string) []string {
+	var ips []string
+	for _, entry := range splitTargetIPs(targetIP) {
+		if net.ParseIP(entry) != nil {
+			ips = append(ips, entry)
+		}
 	}
+	return ips
 }
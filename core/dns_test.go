@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type fakeBackend struct {
+	calls   int32
+	answers map[uint16][]string
+}
+
+func (b *fakeBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	atomic.AddInt32(&b.calls, 1)
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	q := m.Question[0]
+	for _, ip := range b.answers[q.Qtype] {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		if q.Qtype == dns.TypeA {
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(ip)})
+		} else {
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(ip)})
+		}
+	}
+	return reply, "fake", nil
+}
+
+func newTestResolver(cfg *Config, backend dnsBackend) *Resolver {
+	return &Resolver{config: cfg, backend: backend, cache: make(map[string]cacheEntry), msgCache: newMsgCache(cfg.DNSCacheSize, cfg.ServeStale)}
+}
+
+func TestResolveAllDualStack(t *testing.T) {
+	backend := &fakeBackend{answers: map[uint16][]string{
+		dns.TypeA:    {"192.0.2.1", "192.0.2.2"},
+		dns.TypeAAAA: {"2001:db8::1"},
+	}}
+
+	r := newTestResolver(&Config{}, backend)
+	ips, err := r.ResolveAll(context.Background(), "dual.resolver-test.invalid")
+	if err != nil || len(ips) != 2 || ips[0] != "192.0.2.1" {
+		t.Fatalf("IPv6 disabled: ips=%v err=%v", ips, err)
+	}
+
+	r = newTestResolver(&Config{EnableIPv6: true}, backend)
+	ips, err = r.ResolveAll(context.Background(), "dual.resolver-test.invalid")
+	if err != nil || len(ips) != 3 || ips[0] != "2001:db8::1" {
+		t.Fatalf("IPv6 enabled: ips=%v err=%v", ips, err)
+	}
+
+	calls := atomic.LoadInt32(&backend.calls)
+	if _, err := r.ResolveAll(context.Background(), "dual.resolver-test.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&backend.calls) != calls {
+		t.Fatalf("second lookup was not served from cache")
+	}
+}
+
+func TestResolveAllCachesMissingAAAA(t *testing.T) {
+	backend := &fakeBackend{answers: map[uint16][]string{dns.TypeA: {"192.0.2.7"}}}
+	r := newTestResolver(&Config{EnableIPv6: true}, backend)
+
+	for i := 0; i < 3; i++ {
+		ips, err := r.ResolveAll(context.Background(), "v4only.resolver-test.invalid")
+		if err != nil || len(ips) != 1 || ips[0] != "192.0.2.7" {
+			t.Fatalf("ips=%v err=%v", ips, err)
+		}
+	}
+	if calls := atomic.LoadInt32(&backend.calls); calls != 2 {
+		t.Fatalf("backend called %d times, want 2 (one A, one AAAA)", calls)
+	}
+}
+
+func TestDNSOverTCPPipelined(t *testing.T) {
+	if _, err := InitEngine(`{
+		"enable_ipv6": true,
+		"rules": [{"patterns": ["hijack.dns-tcp-test.invalid"], "target_ip": "192.0.2.50"}]
+	}`, nil); err != nil {
+		t.Fatalf("InitEngine: %v", err)
+	}
+	globalEngine.mu.Lock()
+	globalEngine.resolver = newTestResolver(globalEngine.config, &fakeBackend{answers: map[uint16][]string{
+		dns.TypeA: {"192.0.2.60"},
+	}})
+	globalEngine.mu.Unlock()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleDNSTCPConnection(server)
+
+	// Both queries go out before either answer is read.
+	var frames []byte
+	for i, name := range []string{"hijack.dns-tcp-test.invalid.", "upstream.dns-tcp-test.invalid."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Id = uint16(i + 1)
+		data, _ := m.Pack()
+		frames = append(frames, byte(len(data)>>8), byte(len(data)))
+		frames = append(frames, data...)
+	}
+	go client.Write(frames)
+
+	want := map[uint16]string{1: "192.0.2.50", 2: "192.0.2.60"}
+	for range want {
+		co := &dns.Conn{Conn: client}
+		reply, err := co.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg: %v", err)
+		}
+		a, ok := reply.Answer[0].(*dns.A)
+		if !ok || a.A.String() != want[reply.Id] {
+			t.Fatalf("reply %d: %v", reply.Id, reply.Answer)
+		}
+		delete(want, reply.Id)
+	}
+}
+
+func TestDNSUDPSessionTruncates(t *testing.T) {
+	var ips []string
+	for i := 1; i <= 60; i++ {
+		ips = append(ips, fmt.Sprintf("192.0.2.%d", i))
+	}
+	if _, err := InitEngine(fmt.Sprintf(`{
+		"enable_ipv6": true,
+		"rules": [{"patterns": ["many.dns-udp-test.invalid"], "target_ip": %q}]
+	}`, strings.Join(ips, ",")), nil); err != nil {
+		t.Fatalf("InitEngine: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleDNSConnection(server, nil)
+
+	query := func(id uint16, edns uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("many.dns-udp-test.invalid.", dns.TypeA)
+		m.Id = id
+		if edns > 0 {
+			m.SetEdns0(edns, false)
+		}
+		data, _ := m.Pack()
+		if _, err := client.Write(data); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		reply := new(dns.Msg)
+		if err := reply.Unpack(buf[:n]); err != nil {
+			t.Fatalf("unpack: %v", err)
+		}
+		if n > dnsUDPSize(m) {
+			t.Fatalf("reply of %d bytes exceeds %d", n, dnsUDPSize(m))
+		}
+		return reply
+	}
+
+	// Both queries share the flow; only the one without EDNS0 is truncated.
+	if r := query(1, 0); !r.Truncated || len(r.Answer) >= 60 {
+		t.Fatalf("plain query: TC=%v, %d answers", r.Truncated, len(r.Answer))
+	}
+	if r := query(2, 4096); r.Truncated || len(r.Answer) != 60 || r.IsEdns0() == nil {
+		t.Fatalf("EDNS0 query: TC=%v, %d answers", r.Truncated, len(r.Answer))
+	}
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultDNSCacheSize = 4096
+	maxDNSCacheTTL      = 24 * time.Hour
+	// maxNegativeTTL caps how long NXDOMAIN and NODATA answers are kept
+	// (RFC 2308 suggests one to three hours).
+	maxNegativeTTL = 3 * time.Hour
+	// With serve-stale, expired answers stay usable for dnsStaleMaxAge and
+	// are handed out with dnsStaleTTL when the upstreams haven't answered
+	// within dnsStaleAnswerDelay (RFC 8767).
+	dnsStaleMaxAge      = 24 * time.Hour
+	dnsStaleTTL         = 30
+	dnsStaleAnswerDelay = 1800 * time.Millisecond
+)
+
+// msgCache caches whole DNS replies by question, for every query type.
+type msgCache struct {
+	size       int
+	serveStale bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // cache key -> element holding *msgCacheEntry
+	lru     *list.List               // front is most recently used
+	fetches singleflight.Group
+}
+
+type msgCacheEntry struct {
+	key       string
+	reply     *dns.Msg
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+func newMsgCache(size int, serveStale bool) *msgCache {
+	if size <= 0 {
+		size = defaultDNSCacheSize
+	}
+	return &msgCache{
+		size:       size,
+		serveStale: serveStale,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// msgCacheKey identifies the answer to q. The DO bit is part of it, since
+// it changes whether DNSSEC records are included.
+func msgCacheKey(q *dns.Msg) (string, bool) {
+	if len(q.Question) != 1 {
+		return "", false
+	}
+	question := q.Question[0]
+	do := false
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s|%d|%d|%t|%t", strings.ToLower(question.Name), question.Qtype, question.Qclass, q.CheckingDisabled, do), true
+}
+
+// get returns a copy of the cached reply to q with its TTLs counted down,
+// and whether it is stale (only possible with serve-stale).
+func (c *msgCache) get(q *dns.Msg) (*dns.Msg, bool) {
+	key, ok := msgCacheKey(q)
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	entry := el.Value.(*msgCacheEntry)
+	stale := !now.Before(entry.expiresAt)
+	if stale && (!c.serveStale || now.Sub(entry.expiresAt) > dnsStaleMaxAge) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.mu.Unlock()
+
+	reply := entry.reply.Copy()
+	reply.Id = q.Id
+	reply.Question = q.Question
+	elapsed := uint32(now.Sub(entry.storedAt) / time.Second)
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+			case stale:
+				hdr.Ttl = dnsStaleTTL
+			case hdr.Ttl > elapsed:
+				hdr.Ttl -= elapsed
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return reply, stale
+}
+
+// set stores reply to q if it is cacheable: a complete NOERROR or NXDOMAIN
+// answer. Negative answers are kept for their SOA's negative TTL.
+func (c *msgCache) set(q, reply *dns.Msg) {
+	key, ok := msgCacheKey(q)
+	if !ok || reply.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(reply)
+	if !ok || ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	entry := &msgCacheEntry{key: key, reply: reply.Copy(), storedAt: now, expiresAt: now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*msgCacheEntry).key)
+	}
+}
+
+// cacheTTL is how long reply may be cached: the smallest TTL among its
+// records for positive answers, and per RFC 2308 the smaller of the SOA's
+// TTL and MINIMUM for negative ones. Answers without either aren't cached.
+func cacheTTL(reply *dns.Msg) (time.Duration, bool) {
+	switch reply.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+
+	if reply.Rcode == dns.RcodeNameError || len(reply.Answer) == 0 {
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := time.Duration(soa.Hdr.Ttl) * time.Second
+				if m := time.Duration(soa.Minttl) * time.Second; m < ttl {
+					ttl = m
+				}
+				if ttl > maxNegativeTTL {
+					ttl = maxNegativeTTL
+				}
+				return ttl, true
+			}
+		}
+		return 0, false
+	}
+
+	ttl := uint32(maxDNSCacheTTL / time.Second)
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && hdr.Ttl < ttl {
+				ttl = hdr.Ttl
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+// prune drops entries too old to be served even stale.
+func (c *msgCache) prune() {
+	cutoff := time.Now()
+	if c.serveStale {
+		cutoff = cutoff.Add(-dnsStaleMaxAge)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if el.Value.(*msgCacheEntry).expiresAt.Before(cutoff) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Exchange answers q through the message cache, asking the upstreams on a
+// miss. Concurrent misses for the same question share one upstream query.
+// With serve-stale, an expired answer is returned if the upstreams don't
+// answer within dnsStaleAnswerDelay; the refresh carries on in the
+// background and updates the cache when it completes.
+func (r *Resolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+	cached, stale := r.msgCache.get(q)
+	if cached != nil && !stale {
+		return cached, nil
+	}
+
+	key, ok := msgCacheKey(q)
+	if !ok {
+		reply, _, err := r.backend.Exchange(q)
+		return reply, err
+	}
+	ch := r.msgCache.fetches.DoChan(key, func() (any, error) {
+		reply, _, err := r.backend.Exchange(q.Copy())
+		if err != nil {
+			return nil, err
+		}
+		r.msgCache.set(q, reply)
+		return reply, nil
+	})
+
+	var timeout <-chan time.Time
+	if cached != nil {
+		timeout = time.After(dnsStaleAnswerDelay)
+	}
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			if cached != nil {
+				LogDebug("DNS Cache: Serving stale answer for %s: %v", q.Question[0].Name, res.Err)
+				return cached, nil
+			}
+			return nil, res.Err
+		}
+		reply := res.Val.(*dns.Msg).Copy()
+		reply.Id = q.Id
+		reply.Question = q.Question
+		return reply, nil
+	case <-timeout:
+		LogDebug("DNS Cache: Serving stale answer for %s while refreshing", q.Question[0].Name)
+		return cached, nil
+	}
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// scriptedBackend answers with reply (or fails) after delay.
+type scriptedBackend struct {
+	calls int32
+	delay time.Duration
+	fail  atomic.Bool
+	reply func(q *dns.Msg) *dns.Msg
+}
+
+func (b *scriptedBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	atomic.AddInt32(&b.calls, 1)
+	time.Sleep(b.delay)
+	if b.fail.Load() {
+		return nil, "", net.ErrClosed
+	}
+	return b.reply(m), "fake", nil
+}
+
+func aReply(ip string, ttl uint32) func(q *dns.Msg) *dns.Msg {
+	return func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(ip),
+		})
+		return r
+	}
+}
+
+func query(name string, qtype uint16, id uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Id = id
+	return m
+}
+
+// expire backdates every cached entry by d.
+func expire(c *msgCache, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		e := el.Value.(*msgCacheEntry)
+		e.storedAt = e.storedAt.Add(-d)
+		e.expiresAt = e.expiresAt.Add(-d)
+	}
+}
+
+func TestMsgCacheHitRewritesIDAndTTL(t *testing.T) {
+	backend := &scriptedBackend{reply: aReply("192.0.2.1", 300)}
+	r := newTestResolver(&Config{}, backend)
+
+	if _, err := r.Exchange(query("cache.dns-cache-test.invalid.", dns.TypeA, 1)); err != nil {
+		t.Fatal(err)
+	}
+	expire(r.msgCache, 100*time.Second)
+	reply, err := r.Exchange(query("CACHE.dns-cache-test.invalid.", dns.TypeA, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.calls != 1 {
+		t.Fatalf("expected a cache hit, backend called %d times", backend.calls)
+	}
+	if reply.Id != 2 || reply.Question[0].Name != "CACHE.dns-cache-test.invalid." {
+		t.Fatalf("reply not rewritten for the query: id %d, %s", reply.Id, reply.Question[0].Name)
+	}
+	if ttl := reply.Answer[0].Header().Ttl; ttl != 200 {
+		t.Fatalf("TTL = %d, want 200", ttl)
+	}
+}
+
+func TestMsgCacheNegative(t *testing.T) {
+	backend := &scriptedBackend{reply: func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		r.Ns = append(r.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "invalid.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.invalid.",
+			Mbox:   "hostmaster.invalid.",
+			Minttl: 60,
+		})
+		return r
+	}}
+	r := newTestResolver(&Config{}, backend)
+
+	for i := 0; i < 2; i++ {
+		reply, err := r.Exchange(query("nx.dns-cache-test.invalid.", dns.TypeAAAA, 1))
+		if err != nil || reply.Rcode != dns.RcodeNameError {
+			t.Fatalf("reply %v, err %v", reply, err)
+		}
+	}
+	if backend.calls != 1 {
+		t.Fatalf("NXDOMAIN not cached, backend called %d times", backend.calls)
+	}
+	// The negative TTL is the SOA MINIMUM, not the SOA's own TTL.
+	expire(r.msgCache, 61*time.Second)
+	r.Exchange(query("nx.dns-cache-test.invalid.", dns.TypeAAAA, 1))
+	if backend.calls != 2 {
+		t.Fatalf("expired NXDOMAIN served from cache")
+	}
+}
+
+func TestMsgCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	backend := &scriptedBackend{reply: aReply("192.0.2.1", 300)}
+	r := newTestResolver(&Config{DNSCacheSize: 2}, backend)
+
+	r.Exchange(query("a.dns-cache-test.invalid.", dns.TypeA, 1))
+	r.Exchange(query("b.dns-cache-test.invalid.", dns.TypeA, 1))
+	r.Exchange(query("a.dns-cache-test.invalid.", dns.TypeA, 1))
+	r.Exchange(query("c.dns-cache-test.invalid.", dns.TypeA, 1))
+	calls := backend.calls
+
+	r.Exchange(query("a.dns-cache-test.invalid.", dns.TypeA, 1))
+	if backend.calls != calls {
+		t.Fatalf("recently used entry was evicted")
+	}
+	r.Exchange(query("b.dns-cache-test.invalid.", dns.TypeA, 1))
+	if backend.calls != calls+1 {
+		t.Fatalf("least recently used entry was kept")
+	}
+}
+
+func TestMsgCacheServeStale(t *testing.T) {
+	backend := &scriptedBackend{reply: aReply("192.0.2.1", 60)}
+	r := newTestResolver(&Config{ServeStale: true}, backend)
+	r.Exchange(query("stale.dns-cache-test.invalid.", dns.TypeA, 1))
+	expire(r.msgCache, time.Hour)
+
+	// Upstreams down: the expired answer is served with a short TTL.
+	backend.fail.Store(true)
+	reply, err := r.Exchange(query("stale.dns-cache-test.invalid.", dns.TypeA, 2))
+	if err != nil || reply.Answer[0].Header().Ttl != dnsStaleTTL {
+		t.Fatalf("stale reply %v, err %v", reply, err)
+	}
+
+	// Upstreams slow: stale first, and the refresh lands in the cache.
+	backend.fail.Store(false)
+	backend.reply = aReply("192.0.2.2", 60)
+	backend.delay = dnsStaleAnswerDelay + 200*time.Millisecond
+	start := time.Now()
+	reply, err = r.Exchange(query("stale.dns-cache-test.invalid.", dns.TypeA, 3))
+	if err != nil || reply.Answer[0].(*dns.A).A.String() != "192.0.2.1" || time.Since(start) > backend.delay {
+		t.Fatalf("slow upstream: reply %v, err %v after %s", reply, err, time.Since(start))
+	}
+	time.Sleep(500 * time.Millisecond)
+	reply, _ = r.Exchange(query("stale.dns-cache-test.invalid.", dns.TypeA, 4))
+	if reply.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("background refresh not cached: %v", reply.Answer)
+	}
+}
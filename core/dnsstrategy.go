@@ -0,0 +1,181 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsStrategyRace       = "race"
+	dnsStrategyFailover   = "failover"
+	dnsStrategyRoundRobin = "round_robin"
+	dnsStrategyFastest    = "fastest"
+
+	// rttEWMAWeight is the weight of a new sample in the RTT average.
+	rttEWMAWeight = 0.3
+	// With "fastest", every fastestResampleEvery-th query goes to the
+	// slowest upstream first, so one that failed once can earn its place
+	// back.
+	fastestResampleEvery = 16
+)
+
+// UpstreamStats is how one nameserver has been doing, for the UI.
+type UpstreamStats struct {
+	Address   string `json:"address"`
+	Successes int64  `json:"successes"`
+	Failures  int64  `json:"failures"`
+	// RTTMs is a moving average of the response time, failures counting as
+	// the full timeout.
+	RTTMs     int64  `json:"rtt_ms"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type upstreamStats struct {
+	mu        sync.Mutex
+	successes int64
+	failures  int64
+	rtt       time.Duration
+	lastError string
+}
+
+func (s *upstreamStats) record(rtt time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failures++
+		s.lastError = err.Error()
+	} else {
+		s.successes++
+	}
+	if s.successes+s.failures == 1 {
+		s.rtt = rtt
+	} else {
+		s.rtt = time.Duration(rttEWMAWeight*float64(rtt) + (1-rttEWMAWeight)*float64(s.rtt))
+	}
+}
+
+// measured reports the average RTT, and false while there is no sample.
+func (s *upstreamStats) measured() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt, s.successes+s.failures > 0
+}
+
+func newStdBackend(upstreams []stdUpstream, timeout time.Duration, strategy string) *stdBackend {
+	switch strategy {
+	case "":
+		strategy = dnsStrategyRace
+	case dnsStrategyRace, dnsStrategyFailover, dnsStrategyRoundRobin, dnsStrategyFastest:
+	default:
+		LogWarn("DNS: Unknown strategy %q, racing all nameservers", strategy)
+		strategy = dnsStrategyRace
+	}
+	b := &stdBackend{upstreams: upstreams, timeout: timeout, strategy: strategy}
+	b.stats = make([]*upstreamStats, len(upstreams))
+	for i := range b.stats {
+		b.stats[i] = &upstreamStats{}
+	}
+	return b
+}
+
+// exchangeOne queries upstream i and records the outcome.
+func (b *stdBackend) exchangeOne(i int, m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	reply, err := b.upstreams[i].Exchange(m)
+	if err == nil && reply == nil {
+		err = fmt.Errorf("empty reply")
+	}
+	rtt := time.Since(start)
+	if err != nil && rtt < b.timeout {
+		rtt = b.timeout
+	}
+	b.stats[i].record(rtt, err)
+	return reply, err
+}
+
+// order lists the upstreams in the order the strategy tries them.
+func (b *stdBackend) order() []int {
+	n := len(b.upstreams)
+	idx := make([]int, n)
+	start := 0
+	if b.strategy == dnsStrategyRoundRobin {
+		start = int((b.next.Add(1) - 1) % uint32(n))
+	}
+	for i := range idx {
+		idx[i] = (start + i) % n
+	}
+	if b.strategy == dnsStrategyFastest {
+		// Unmeasured upstreams go first so each gets a sample.
+		rtts := make([]time.Duration, n)
+		for i := range rtts {
+			if rtt, ok := b.stats[i].measured(); ok {
+				rtts[i] = rtt
+			} else {
+				rtts[i] = -1
+			}
+		}
+		sort.SliceStable(idx, func(a, c int) bool { return rtts[idx[a]] < rtts[idx[c]] })
+		if n > 1 && b.next.Add(1)%fastestResampleEvery == 0 {
+			idx = append([]int{idx[n-1]}, idx[:n-1]...)
+		}
+	}
+	return idx
+}
+
+// exchangeOrdered asks one upstream at a time, moving to the next on
+// failure.
+func (b *stdBackend) exchangeOrdered(m *dns.Msg) (*dns.Msg, string, error) {
+	var errs []string
+	for _, i := range b.order() {
+		reply, err := b.exchangeOne(i, m)
+		if err == nil {
+			return reply, b.upstreams[i].Address(), nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", b.upstreams[i].Address(), err))
+	}
+	return nil, "", fmt.Errorf("all nameservers failed: %s", strings.Join(errs, "; "))
+}
+
+// Stats returns the per-upstream counters in configuration order.
+func (b *stdBackend) Stats() []UpstreamStats {
+	out := make([]UpstreamStats, len(b.upstreams))
+	for i, u := range b.upstreams {
+		s := b.stats[i]
+		s.mu.Lock()
+		out[i] = UpstreamStats{
+			Address:   u.Address(),
+			Successes: s.successes,
+			Failures:  s.failures,
+			RTTMs:     s.rtt.Milliseconds(),
+			LastError: s.lastError,
+		}
+		s.mu.Unlock()
+	}
+	return out
+}
+
+// GetDNSStats returns the counters of the configured nameservers as a JSON
+// array of UpstreamStats.
+func GetDNSStats() string {
+	globalEngine.mu.RLock()
+	resolver := globalEngine.resolver
+	globalEngine.mu.RUnlock()
+
+	stats := []UpstreamStats{}
+	if resolver != nil {
+		if b, ok := resolver.backend.(*stdBackend); ok {
+			stats = b.Stats()
+		}
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
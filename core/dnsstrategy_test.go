@@ -0,0 +1,120 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type namedUpstream struct {
+	name  string
+	delay time.Duration
+	fail  bool
+	calls atomic.Int32
+}
+
+func (u *namedUpstream) Address() string { return u.name }
+func (u *namedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.calls.Add(1)
+	time.Sleep(u.delay)
+	if u.fail {
+		return nil, errors.New("refused")
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	return reply, nil
+}
+
+func strategyQuery() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("strategy-test.invalid.", dns.TypeA)
+	return m
+}
+
+func TestDNSStrategyFailover(t *testing.T) {
+	down := &namedUpstream{name: "down", fail: true}
+	up := &namedUpstream{name: "up"}
+	spare := &namedUpstream{name: "spare"}
+	b := newStdBackend([]stdUpstream{down, up, spare}, time.Second, dnsStrategyFailover)
+
+	_, addr, err := b.Exchange(strategyQuery())
+	if err != nil || addr != "up" {
+		t.Fatalf("answered by %q, err %v", addr, err)
+	}
+	if spare.calls.Load() != 0 {
+		t.Fatal("failover asked past the first working nameserver")
+	}
+
+	stats := b.Stats()
+	if stats[0].Failures != 1 || stats[0].LastError == "" || stats[1].Successes != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestDNSStrategyRoundRobin(t *testing.T) {
+	a := &namedUpstream{name: "a"}
+	c := &namedUpstream{name: "c"}
+	b := newStdBackend([]stdUpstream{a, c}, time.Second, dnsStrategyRoundRobin)
+
+	for i := 0; i < 4; i++ {
+		b.Exchange(strategyQuery())
+	}
+	if a.calls.Load() != 2 || c.calls.Load() != 2 {
+		t.Fatalf("calls a=%d c=%d", a.calls.Load(), c.calls.Load())
+	}
+}
+
+func TestDNSStrategyFastest(t *testing.T) {
+	slow := &namedUpstream{name: "slow", delay: 50 * time.Millisecond}
+	fast := &namedUpstream{name: "fast"}
+	b := newStdBackend([]stdUpstream{slow, fast}, time.Second, dnsStrategyFastest)
+
+	// The first queries measure each nameserver once.
+	b.Exchange(strategyQuery())
+	b.Exchange(strategyQuery())
+	for i := 0; i < 3; i++ {
+		if _, addr, _ := b.Exchange(strategyQuery()); addr != "fast" {
+			t.Fatalf("query %d answered by %q", i, addr)
+		}
+	}
+	if slow.calls.Load() != 1 {
+		t.Fatalf("slow nameserver asked %d times", slow.calls.Load())
+	}
+}
+
+func TestGetDNSStats(t *testing.T) {
+	if _, err := InitEngine(`{"nameservers": ["192.0.2.1", "tls://dns.strategy-test.invalid"], "dns_strategy": "failover"}`, nil); err != nil {
+		t.Fatalf("InitEngine: %v", err)
+	}
+	var stats []UpstreamStats
+	if err := json.Unmarshal([]byte(GetDNSStats()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Address != "192.0.2.1:53" || stats[1].Address != "dns.strategy-test.invalid:853" {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestDNSStrategyFastestResamples(t *testing.T) {
+	flaky := &namedUpstream{name: "flaky", fail: true}
+	steady := &namedUpstream{name: "steady", delay: 5 * time.Millisecond}
+	b := newStdBackend([]stdUpstream{flaky, steady}, time.Second, dnsStrategyFastest)
+
+	// One failure costs flaky a full-timeout sample and sends it to the back.
+	b.Exchange(strategyQuery())
+	flaky.fail = false
+	calls := flaky.calls.Load()
+	for i := 0; i < fastestResampleEvery; i++ {
+		b.Exchange(strategyQuery())
+	}
+	if flaky.calls.Load() == calls {
+		t.Fatal("the slowest nameserver was never sampled again")
+	}
+	if rtt, _ := b.stats[0].measured(); rtt >= time.Second {
+		t.Fatalf("flaky RTT still %s after a fresh sample", rtt)
+	}
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	strategyECH = "ech"
+	// echAttemptTimeout bounds each ECH dial and handshake, so a server that
+	// swallows the ClientHello doesn't hold up the fallback.
+	echAttemptTimeout = 5 * time.Second
+)
+
+// errNoECHConfig means neither the rule nor DNS offered an ECHConfigList.
+var errNoECHConfig = errors.New("no ECH config")
+
+// LookupECH returns the ECHConfigList published in the HTTPS record of host,
+// or nil if there is none. An AliasMode record is followed once. Answers,
+// including the absence of one, are cached like address lookups.
+func (r *Resolver) LookupECH(ctx context.Context, host string) ([]byte, error) {
+	if cached, ok := r.getCache(host, dns.TypeHTTPS); ok {
+		if len(cached) == 0 {
+			return nil, nil
+		}
+		return base64.StdEncoding.DecodeString(cached[0])
+	}
+	if r.backend == nil {
+		return nil, fmt.Errorf("no DNS backend for HTTPS records")
+	}
+
+	name := host
+	for hop := 0; hop < 2; hop++ {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), dns.TypeHTTPS)
+		m.RecursionDesired = true
+		reply, _, err := r.backend.Exchange(m)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("dns error: %s", dns.RcodeToString[reply.Rcode])
+		}
+
+		alias := ""
+		for _, ans := range reply.Answer {
+			rr, ok := ans.(*dns.HTTPS)
+			if !ok {
+				continue
+			}
+			if rr.Priority == 0 {
+				if rr.Target != "." {
+					alias = strings.TrimSuffix(rr.Target, ".")
+				}
+				continue
+			}
+			for _, kv := range rr.Value {
+				if ech, ok := kv.(*dns.SVCBECHConfig); ok && len(ech.ECH) > 0 {
+					r.setCache(host, []string{base64.StdEncoding.EncodeToString(ech.ECH)}, dns.TypeHTTPS, rr.Hdr.Ttl)
+					return ech.ECH, nil
+				}
+			}
+		}
+		if alias == "" || alias == name {
+			break
+		}
+		name = alias
+	}
+	r.setCache(host, []string{}, dns.TypeHTTPS, 0)
+	return nil, nil
+}
+
+// echConfigFor returns the ECHConfigList to use for host: the rule's static
+// ech_config if set, otherwise the one from DNS.
+func echConfigFor(ctx context.Context, host string, rule *HostPolicy) ([]byte, error) {
+	if rule != nil && rule.ECHConfig != "" {
+		config, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rule.ECHConfig))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ech_config: %v", err)
+		}
+		return config, nil
+	}
+
+	globalEngine.mu.RLock()
+	resolver := globalEngine.resolver
+	globalEngine.mu.RUnlock()
+	if resolver == nil {
+		return nil, errNoECHConfig
+	}
+	config, err := resolver.LookupECH(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(config) == 0 {
+		return nil, errNoECHConfig
+	}
+	return config, nil
+}
+
+// echHandshake connects to one of targets with the real host name in the
+// encrypted inner ClientHello; the outer one carries the public name of the
+// ECH config. If the server rejects ECH but sends fresh retry configs, the
+// handshake is retried once with them. Each attempt gets echAttemptTimeout.
+// Any error means ECH can't be used for this connection and the caller
+// should fall back to rewriting the SNI.
+func echHandshake(ctx context.Context, host string, targets []string, rule *HostPolicy, ch *clientHelloInfo) (*upstreamConn, string, error) {
+	config, err := echConfigFor(ctx, host, rule)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var alpn []string
+	if ch != nil {
+		alpn = ch.ALPN
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, echAttemptTimeout)
+		rawRemote, actualTarget, err := dialTargets(attemptCtx, targets)
+		if err != nil {
+			cancel()
+			return nil, "", err
+		}
+
+		cfg := upstreamTLSConfig(host, host, rule)
+		cfg.NextProtos = alpn
+		cfg.MinVersion = tls.VersionTLS13
+		cfg.EncryptedClientHelloConfigList = config
+
+		LogDebug("TLS Client: Using ECH for %s to %s", host, actualTarget)
+		tlsRemote := tls.Client(rawRemote, cfg)
+		err = tlsRemote.HandshakeContext(attemptCtx)
+		cancel()
+		if err == nil {
+			return &upstreamConn{Conn: tlsRemote, negotiatedProtocol: tlsRemote.ConnectionState().NegotiatedProtocol}, actualTarget, nil
+		}
+		rawRemote.Close()
+
+		var rejected *tls.ECHRejectionError
+		if !errors.As(err, &rejected) || len(rejected.RetryConfigList) == 0 || attempt > 0 {
+			return nil, actualTarget, err
+		}
+		LogInfo("TLS Client: ECH rejected by %s for %s, retrying with the server's configs", actualTarget, host)
+		config = rejected.RetryConfigList
+	}
+	return nil, "", errNoECHConfig
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type httpsBackend struct {
+	calls   int
+	records map[string]*dns.HTTPS
+}
+
+func (b *httpsBackend) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	b.calls++
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	if rr, ok := b.records[m.Question[0].Name]; ok {
+		rr.Hdr = dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300}
+		reply.Answer = append(reply.Answer, rr)
+	}
+	return reply, "fake", nil
+}
+
+func TestLookupECH(t *testing.T) {
+	config := []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+	backend := &httpsBackend{records: map[string]*dns.HTTPS{
+		"alias.ech-test.invalid.": {SVCB: dns.SVCB{Priority: 0, Target: "svc.ech-test.invalid."}},
+		"svc.ech-test.invalid.": {SVCB: dns.SVCB{Priority: 1, Target: ".", Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h2"}},
+			&dns.SVCBECHConfig{ECH: config},
+		}}},
+	}}
+	r := newTestResolver(&Config{}, backend)
+
+	got, err := r.LookupECH(context.Background(), "alias.ech-test.invalid")
+	if err != nil || !bytes.Equal(got, config) {
+		t.Fatalf("alias: got %x, err %v", got, err)
+	}
+	calls := backend.calls
+	if got, _ := r.LookupECH(context.Background(), "alias.ech-test.invalid"); !bytes.Equal(got, config) || backend.calls != calls {
+		t.Fatalf("second lookup was not served from cache")
+	}
+
+	got, err = r.LookupECH(context.Background(), "none.ech-test.invalid")
+	if err != nil || got != nil {
+		t.Fatalf("no record: got %x, err %v", got, err)
+	}
+	calls = backend.calls
+	r.LookupECH(context.Background(), "none.ech-test.invalid")
+	if backend.calls != calls {
+		t.Fatalf("missing record was not cached")
+	}
+}
+
+func TestECHConfigForStatic(t *testing.T) {
+	got, err := echConfigFor(context.Background(), "static.ech-test.invalid", &HostPolicy{ECHConfig: "AAT+DQAA"})
+	if err != nil || !bytes.Equal(got, []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}) {
+		t.Fatalf("got %x, err %v", got, err)
+	}
+	if _, err := echConfigFor(context.Background(), "static.ech-test.invalid", &HostPolicy{ECHConfig: "not base64!"}); err == nil {
+		t.Fatal("invalid ech_config accepted")
+	}
+}
+
+// testECHConfigList is a well-formed ECHConfigList for an X25519 key nobody
+// holds, with public name public.ech-test.invalid.
+func testECHConfigList(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicName := "public.ech-test.invalid"
+	var contents []byte
+	contents = append(contents, 1)          // config_id
+	contents = append(contents, 0x00, 0x20) // DHKEM(X25519, HKDF-SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, 32)
+	contents = append(contents, key.PublicKey().Bytes()...)
+	contents = append(contents, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01) // HKDF-SHA256, AES-128-GCM
+	contents = append(contents, 0)                                  // maximum_name_length
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0x00, 0x00) // extensions
+
+	config := []byte{0xfe, 0x0d}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+func TestECHFallsBackWhenBlackholed(t *testing.T) {
+	cm, roots := useTestCA(t)
+	upstreamCert, err := cm.GetLeafCert([]string{"front.ech-test.invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first connection, the ECH attempt, gets no answer; later ones are
+	// served normally.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fallbackSNI := make(chan string, 1)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				defer conn.Close()
+				continue
+			}
+			srv := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*upstreamCert}})
+			if srv.Handshake() == nil {
+				fallbackSNI <- srv.ConnectionState().ServerName
+				srv.Read(make([]byte, 1))
+			}
+			srv.Close()
+		}
+	}()
+
+	if _, err := InitEngine(fmt.Sprintf(`{
+		"rules": [{"patterns": ["www.ech-test.invalid"], "strategy": "ech", "ech_config": %q,
+			"target_sni": "front.ech-test.invalid", "target_ip": "127.0.0.1"}],
+		"cert_verify": [{"patterns": ["www.ech-test.invalid"], "verify": false}]
+	}`, base64.StdEncoding.EncodeToString(testECHConfigList(t))), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client, local := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		handleProxyConnection(local, ln.Addr().String(), nil)
+		close(done)
+	}()
+
+	start := time.Now()
+	conn := tls.Client(client, &tls.Config{ServerName: "www.ech-test.invalid", RootCAs: roots})
+	conn.SetDeadline(start.Add(echAttemptTimeout + 5*time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("no fallback after %s: %v", time.Since(start), err)
+	}
+	if sni := <-fallbackSNI; sni != "front.ech-test.invalid" {
+		t.Errorf("fallback sent SNI %q", sni)
+	}
+	conn.Write([]byte("x"))
+	conn.Close()
+	<-done
+}
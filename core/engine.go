@@ -13,6 +13,37 @@ type Rule struct {
 	TargetSNI  *string  `json:"target_sni"`
 	TargetIP   *string  `json:"target_ip"`
 	CertVerify any      `json:"cert_verify"`
+	// Strategy selects how a matched HTTPS connection hides its SNI:
+	// "mitm" (default, rewrite TargetSNI), "fragment" (split the original
+	// ClientHello and pass the encryption through untouched) or "ech"
+	// (encrypt the real name upstream, falling back to "mitm").
+	Strategy string           `json:"strategy"`
+	Fragment *FragmentOptions `json:"fragment"`
+	// QUIC is the policy for HTTP/3 traffic to matched hosts: "block"
+	// (default, forces a TCP fallback) or "pass".
+	QUIC string `json:"quic"`
+	// UpgradeHTTPS sends plain HTTP requests for matched hosts to port 443
+	// over TLS, so the SNI settings of the rule apply to them too.
+	UpgradeHTTPS bool `json:"upgrade_https"`
+	// Adaptive retries a failed upstream handshake with other SNI choices
+	// (no SNI, the original one, AltSNI) and other target IPs, remembering
+	// per domain what worked.
+	Adaptive bool     `json:"adaptive"`
+	AltSNI   []string `json:"alt_sni"`
+	// Fingerprint makes the upstream ClientHello of intercepted connections
+	// look like a browser's: "chrome", "firefox", "safari", "edge", "ios", or
+	// "passthrough" to copy the client's own. Empty uses Go's.
+	Fingerprint string `json:"fingerprint"`
+	// ECHConfig is a base64 ECHConfigList for the "ech" strategy. Empty
+	// looks it up in the host's HTTPS DNS record.
+	ECHConfig string `json:"ech_config"`
+}
+
+// hasOptions reports whether the rule sets any per-connection option beyond
+// what the shared rule tables carry.
+func (r *Rule) hasOptions() bool {
+	return r.Strategy != "" || r.Fragment != nil || r.QUIC != "" || r.UpgradeHTTPS ||
+		r.Adaptive || len(r.AltSNI) > 0 || r.Fingerprint != "" || r.ECHConfig != ""
 }
 
 type CertVerifyRule struct {
@@ -26,17 +57,38 @@ type Config struct {
 	NameServers  []string         `json:"nameservers"`
 	BootstrapDNS []string         `json:"bootstrap_dns"`
 	CheckHN      bool             `json:"check_hostname"`
-	MTU          int              `json:"mtu"`
-	EnableIPv6   bool             `json:"enable_ipv6"`
-	LogLevel     string           `json:"log_level"`
+	// CheckHNPolicy is what happens when the destination IP doesn't belong to
+	// the SNI: "allow" (log only), "direct" (default, no rewrite) or "drop".
+	CheckHNPolicy string `json:"check_hostname_policy"`
+	MTU           int    `json:"mtu"`
+	EnableIPv6    bool   `json:"enable_ipv6"`
+	LogLevel      string `json:"log_level"`
+	// SniffPorts limits protocol detection to these destination ports
+	// (empty: all ports). Detection waits up to 500ms for the client to speak,
+	// which server-first protocols on sniffed ports pay before their first
+	// byte. NoSniffPorts are always forwarded untouched; when unset, a
+	// default list of server-first and mail ports is used.
+	SniffPorts   []int `json:"sniff_ports"`
+	NoSniffPorts []int `json:"no_sniff_ports"`
+	// ProbeInterval is how often, in seconds, the target IPs of user rules
+	// are health checked (0: every 10 minutes, negative: never).
+	ProbeInterval int `json:"probe_interval"`
+	// DNSCacheSize bounds the number of DNS answers cached for apps (0: 4096).
+	// ServeStale answers from expired entries when the upstreams are slow.
+	DNSCacheSize int  `json:"dns_cache_size"`
+	ServeStale   bool `json:"serve_stale"`
+	// DNSStrategy is how nameservers are queried: "race" (default, all at
+	// once), "failover" (in order), "round_robin" or "fastest".
+	DNSStrategy string `json:"dns_strategy"`
 }
 
 type Engine struct {
-	mu       sync.RWMutex
-	rules    *ruleslib.Rules
-	config   *Config
-	resolver *Resolver
-	cb       EngineCallbacks
+	mu        sync.RWMutex
+	rules     *ruleslib.Rules
+	userRules []Rule
+	config    *Config
+	resolver  *Resolver
+	cb        EngineCallbacks
 }
 
 var globalEngine = &Engine{}
@@ -74,6 +126,7 @@ func InitEngine(jsonConfig string, cb EngineCallbacks) (*Config, error) {
 
 	globalEngine.mu.Lock()
 	globalEngine.rules = rules
+	globalEngine.userRules = config.Rules
 	globalEngine.config = &config
 	globalEngine.cb = cb
 	SetLogLevel(config.LogLevel)
@@ -98,7 +151,11 @@ func InitEngine(jsonConfig string, cb EngineCallbacks) (*Config, error) {
 		if r.CertVerify != nil {
 			verifyDisplay = fmt.Sprintf("%v", r.CertVerify)
 		}
-		LogDebug("Rule[%d]: SNI=%s, IP=%s, Verify=%s, Patterns=%v", i, sniDisplay, ipDisplay, verifyDisplay, r.Patterns)
+		strategyDisplay := strategyMITM
+		if r.Strategy != "" {
+			strategyDisplay = r.Strategy
+		}
+		LogDebug("Rule[%d]: SNI=%s, IP=%s, Verify=%s, Strategy=%s, Patterns=%v", i, sniDisplay, ipDisplay, verifyDisplay, strategyDisplay, r.Patterns)
 	}
 	for i, r := range config.CertVerify {
 		LogDebug("CertVerify[%d]: Verify=%v, Patterns=%v", i, r.Verify, r.Patterns)
@@ -106,21 +163,123 @@ func InitEngine(jsonConfig string, cb EngineCallbacks) (*Config, error) {
 	return &config, nil
 }
 
-func (e *Engine) Match(sni string) *Rule {
+// HostPolicy is everything the rules say about one hostname, merged from
+// alter_hostname, hosts, cert_verify and the matching user rule. The
+// *Pattern fields name the pattern each value came from, for logging.
+type HostPolicy struct {
+	Host string
+
+	TargetSNI         *string
+	SNIPattern        string
+	TargetIP          *string
+	IPPattern         string
+	CertVerify        any
+	CertVerifyPattern string
+
+	Strategy     string
+	Fragment     *FragmentOptions
+	QUIC         string
+	UpgradeHTTPS bool
+	Adaptive     bool
+	AltSNI       []string
+	Fingerprint  string
+	ECHConfig    string
+	UserPattern  string
+}
+
+// Match resolves the policy for host. It returns nil when no alter_hostname,
+// hosts or user rule applies; cert_verify alone does not make a match.
+func (e *Engine) Match(host string) *HostPolicy {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	LogDebug("Engine: Matching SNI '%s' against rules", sni)
+	LogDebug("Engine: Matching '%s' against rules", host)
 
-	targetSNI, ok := e.rules.GetAlterHostname(sni)
-	if !ok {
+	if e.rules == nil {
+		return nil
+	}
+
+	p := &HostPolicy{Host: host}
+	matched := false
+
+	if targetSNI, ok := e.rules.GetAlterHostname(host); ok {
+		p.TargetSNI = &targetSNI
+		p.SNIPattern = matchingPattern(e.rules.AlterHostname, host)
+		matched = true
+	}
+	if targetIP, ok := e.rules.GetHost(host); ok && targetIP != "" {
+		p.TargetIP = &targetIP
+		p.IPPattern = matchingPattern(e.rules.Hosts, host)
+		matched = true
+	}
+
+	userRule, userPattern := e.matchUserRule(host)
+	if userRule != nil {
+		p.Strategy = userRule.Strategy
+		p.Fragment = userRule.Fragment
+		p.QUIC = userRule.QUIC
+		p.UpgradeHTTPS = userRule.UpgradeHTTPS
+		p.Adaptive = userRule.Adaptive
+		p.AltSNI = userRule.AltSNI
+		p.Fingerprint = userRule.Fingerprint
+		p.ECHConfig = userRule.ECHConfig
+		p.UserPattern = userPattern
+		if userRule.hasOptions() {
+			matched = true
+		}
+	}
+	if !matched {
 		return nil
 	}
 
-	return &Rule{
-		Patterns:  []string{sni},
-		TargetSNI: &targetSNI,
+	if userRule != nil && userRule.CertVerify != nil {
+		p.CertVerify = userRule.CertVerify
+		p.CertVerifyPattern = userPattern
+	} else if verify := e.matchCertVerifyLocked(host); verify != nil {
+		p.CertVerify = verify
+		p.CertVerifyPattern = matchingPattern(e.rules.CertVerify, host)
+	}
+
+	LogDebug("Engine: Policy for '%s': SNI=%s (%s), IP=%s (%s), Verify=%v (%s), Strategy=%q",
+		host, ptrDisplay(p.TargetSNI), p.SNIPattern, ptrDisplay(p.TargetIP), p.IPPattern,
+		p.CertVerify, p.CertVerifyPattern, p.Strategy)
+	return p
+}
+
+// matchingPattern returns the most specific (longest) pattern in table that
+// matches host. The rule tables do the actual lookup; this only recovers
+// which entry was used.
+func matchingPattern[V any](table map[string]V, host string) string {
+	best := ""
+	for pattern := range table {
+		if len(pattern) > len(best) && MatchPattern(pattern, host) {
+			best = pattern
+		}
+	}
+	return best
+}
+
+func ptrDisplay(s *string) string {
+	if s == nil {
+		return "<original>"
+	}
+	if *s == "" {
+		return "<strip>"
+	}
+	return *s
+}
+
+// matchUserRule returns the first user rule with a pattern matching host,
+// and that pattern. Callers must hold e.mu.
+func (e *Engine) matchUserRule(host string) (*Rule, string) {
+	for i := range e.userRules {
+		for _, pattern := range e.userRules[i].Patterns {
+			if MatchPattern(pattern, host) {
+				return &e.userRules[i], pattern
+			}
+		}
 	}
+	return nil, ""
 }
 
 func (e *Engine) MatchCertVerify(sni string) any {
@@ -129,6 +288,15 @@ func (e *Engine) MatchCertVerify(sni string) any {
 
 	LogDebug("Engine: Matching CertVerify for '%s' against rules", sni)
 
+	return e.matchCertVerifyLocked(sni)
+}
+
+// matchCertVerifyLocked is MatchCertVerify for callers already holding e.mu.
+func (e *Engine) matchCertVerifyLocked(sni string) any {
+	if e.rules == nil {
+		return nil
+	}
+
 	certPolicy, ok := e.rules.GetCertVerify(sni)
 	if !ok {
 		return nil
@@ -0,0 +1,69 @@
+package core
+
+import "testing"
+
+func TestMatchMergesPolicy(t *testing.T) {
+	_, err := InitEngine(`{
+		"rules": [
+			{"patterns": ["*.policy-test.invalid"], "target_sni": "front.policy-test.invalid", "target_ip": "192.0.2.10"},
+			{"patterns": ["frag.policy-test.invalid"], "strategy": "fragment", "quic": "pass"}
+		],
+		"cert_verify": [
+			{"patterns": ["*.policy-test.invalid"], "verify": false}
+		]
+	}`, nil)
+	if err != nil {
+		t.Fatalf("InitEngine: %v", err)
+	}
+
+	p := globalEngine.Match("www.policy-test.invalid")
+	if p == nil {
+		t.Fatalf("expected a policy")
+	}
+	if p.TargetSNI == nil || *p.TargetSNI != "front.policy-test.invalid" || p.SNIPattern != "*.policy-test.invalid" {
+		t.Errorf("TargetSNI = %v (%s)", ptrDisplay(p.TargetSNI), p.SNIPattern)
+	}
+	if p.TargetIP == nil || *p.TargetIP != "192.0.2.10" || p.IPPattern != "*.policy-test.invalid" {
+		t.Errorf("TargetIP = %v (%s)", ptrDisplay(p.TargetIP), p.IPPattern)
+	}
+	if p.CertVerify != false || p.CertVerifyPattern != "*.policy-test.invalid" {
+		t.Errorf("CertVerify = %v (%s)", p.CertVerify, p.CertVerifyPattern)
+	}
+
+	// The first user rule wins for per-connection options, but the hosts and
+	// alter_hostname tables still apply.
+	f := globalEngine.Match("frag.policy-test.invalid")
+	if f == nil || f.TargetIP == nil {
+		t.Fatalf("expected hosts entry for fragment host, got %+v", f)
+	}
+
+	if globalEngine.Match("unrelated.invalid") != nil {
+		t.Errorf("unexpected policy for unrelated host")
+	}
+}
+
+func TestMatchOptionOnlyRule(t *testing.T) {
+	for _, option := range []string{
+		`"fingerprint": "chrome"`,
+		`"adaptive": true`,
+		`"alt_sni": ["cdn.policy-test.invalid"]`,
+		`"ech_config": "AAT+DQAA"`,
+		`"fragment": {}`,
+	} {
+		_, err := InitEngine(`{"rules": [{"patterns": ["opt.policy-test.invalid"], `+option+`}]}`, nil)
+		if err != nil {
+			t.Fatalf("InitEngine: %v", err)
+		}
+		if globalEngine.Match("opt.policy-test.invalid") == nil {
+			t.Errorf("rule with only %s did not match", option)
+		}
+	}
+
+	if _, err := InitEngine(`{"rules": [{"patterns": ["opt.policy-test.invalid"], "fingerprint": "firefox"}]}`, nil); err != nil {
+		t.Fatalf("InitEngine: %v", err)
+	}
+	p := globalEngine.Match("opt.policy-test.invalid")
+	if p == nil || p.Fingerprint != "firefox" || p.TargetSNI != nil || p.TargetIP != nil {
+		t.Fatalf("fingerprint-only policy = %+v", p)
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	fingerprintGo          = "go"
+	fingerprintChrome      = "chrome"
+	fingerprintFirefox     = "firefox"
+	fingerprintSafari      = "safari"
+	fingerprintEdge        = "edge"
+	fingerprintIOS         = "ios"
+	fingerprintPassthrough = "passthrough"
+
+	extEarlyData = 42
+)
+
+var fingerprintHelloIDs = map[string]utls.ClientHelloID{
+	fingerprintChrome:  utls.HelloChrome_Auto,
+	fingerprintFirefox: utls.HelloFirefox_Auto,
+	fingerprintSafari:  utls.HelloSafari_Auto,
+	fingerprintEdge:    utls.HelloEdge_Auto,
+	fingerprintIOS:     utls.HelloIOS_Auto,
+}
+
+// upstreamConn is an established upstream TLS connection, from crypto/tls or
+// utls.
+type upstreamConn struct {
+	net.Conn
+	negotiatedProtocol string
+}
+
+// fingerprintSpec returns the ClientHello layout to send for the given
+// fingerprint, with the SNI and ALPN replaced by ours. "passthrough" copies
+// the client's own ClientHello (ch). A nil spec means Go's default.
+func fingerprintSpec(fingerprint, targetSNI string, alpn []string, ch *clientHelloInfo) (*utls.ClientHelloSpec, error) {
+	var spec *utls.ClientHelloSpec
+	switch fp := strings.ToLower(fingerprint); fp {
+	case "", fingerprintGo:
+		return nil, nil
+	case fingerprintPassthrough:
+		if ch == nil || len(ch.raw) == 0 {
+			return nil, fmt.Errorf("no client ClientHello to pass through")
+		}
+		// The fingerprinter wants a single record around the handshake.
+		record := make([]byte, recordHeaderLen, recordHeaderLen+len(ch.raw))
+		record[0] = recordTypeHandshake
+		binary.BigEndian.PutUint16(record[1:3], tls.VersionTLS10)
+		binary.BigEndian.PutUint16(record[3:5], uint16(len(ch.raw)))
+		record = append(record, ch.raw...)
+		f := &utls.Fingerprinter{AllowBluntMimicry: true}
+		s, err := f.FingerprintClientHello(record)
+		if err != nil {
+			return nil, err
+		}
+		spec = s
+	default:
+		id, ok := fingerprintHelloIDs[fp]
+		if !ok {
+			return nil, fmt.Errorf("unknown fingerprint %q", fingerprint)
+		}
+		s, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, err
+		}
+		spec = &s
+	}
+
+	// Rewrite the SNI and ALPN, and drop what can't be replayed: the client's
+	// PSK belongs to a session with the real server, not with us.
+	exts := spec.Extensions[:0]
+	for _, ext := range spec.Extensions {
+		switch e := ext.(type) {
+		case *utls.SNIExtension:
+			if targetSNI == "" {
+				continue
+			}
+			e.ServerName = targetSNI
+		case *utls.ALPNExtension:
+			if len(alpn) == 0 {
+				continue
+			}
+			e.AlpnProtocols = alpn
+		case utls.PreSharedKeyExtension:
+			continue
+		case *utls.GenericExtension:
+			if e.Id == extEarlyData {
+				continue
+			}
+		}
+		exts = append(exts, ext)
+	}
+	spec.Extensions = exts
+	return spec, nil
+}
+
+// utlsConfig carries the settings of an upstream crypto/tls config over to
+// utls.
+func utlsConfig(cfg *tls.Config) *utls.Config {
+	uc := &utls.Config{
+		ServerName:         cfg.ServerName,
+		RootCAs:            cfg.RootCAs,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		NextProtos:         cfg.NextProtos,
+	}
+	if verify := cfg.VerifyConnection; verify != nil {
+		uc.VerifyConnection = func(cs utls.ConnectionState) error {
+			return verify(tls.ConnectionState{
+				ServerName:       cs.ServerName,
+				PeerCertificates: cs.PeerCertificates,
+			})
+		}
+	}
+	return uc
+}
+
+// utlsHandshake runs the upstream handshake on rawConn with the ClientHello
+// described by spec.
+func utlsHandshake(ctx context.Context, rawConn net.Conn, cfg *tls.Config, spec *utls.ClientHelloSpec) (*upstreamConn, error) {
+	uconn := utls.UClient(rawConn, utlsConfig(cfg), utls.HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		return nil, fmt.Errorf("apply fingerprint: %v", err)
+	}
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		logRemoteCertificate(rawConn.RemoteAddr().String(), uconn.ConnectionState().PeerCertificates)
+		return nil, err
+	}
+	return &upstreamConn{Conn: uconn, negotiatedProtocol: uconn.ConnectionState().NegotiatedProtocol}, nil
+}
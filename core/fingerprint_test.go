@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestFingerprintSpecRewritesSNIAndALPN(t *testing.T) {
+	hello := captureClientHello(t, "client.example.com", []string{"h2", "http/1.1"})
+	_, raw, err := readClientHello(&PrefixConn{Prefix: hello})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := parseClientHello(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fp := range []string{fingerprintChrome, fingerprintFirefox, fingerprintPassthrough} {
+		spec, err := fingerprintSpec(fp, "front.example.net", []string{"http/1.1"}, ch)
+		if err != nil {
+			t.Fatalf("%s: %v", fp, err)
+		}
+		var sni, alpn bool
+		for _, ext := range spec.Extensions {
+			switch e := ext.(type) {
+			case *utls.SNIExtension:
+				sni = e.ServerName == "front.example.net"
+			case *utls.ALPNExtension:
+				alpn = len(e.AlpnProtocols) == 1 && e.AlpnProtocols[0] == "http/1.1"
+			case utls.PreSharedKeyExtension:
+				t.Errorf("%s: PSK extension kept", fp)
+			}
+		}
+		if !sni || !alpn {
+			t.Errorf("%s: sni rewritten=%v alpn rewritten=%v", fp, sni, alpn)
+		}
+
+		spec, _ = fingerprintSpec(fp, "", nil, ch)
+		for _, ext := range spec.Extensions {
+			switch ext.(type) {
+			case *utls.SNIExtension, *utls.ALPNExtension:
+				t.Errorf("%s: %T kept when stripping", fp, ext)
+			}
+		}
+	}
+
+	if spec, err := fingerprintSpec("", "x", nil, ch); spec != nil || err != nil {
+		t.Fatalf("default fingerprint = %v, %v", spec, err)
+	}
+	if _, err := fingerprintSpec("netscape", "x", nil, ch); err == nil {
+		t.Fatal("unknown fingerprint accepted")
+	}
+}
+
+func TestUpstreamHandshakeWithFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	cm, err := NewCertManager(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	cert, err := cm.GetLeafCert([]string{"front.example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(chan string, 1)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		GetConfigForClient: func(hi *tls.ClientHelloInfo) (*tls.Config, error) {
+			seen <- hi.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.(*tls.Conn).Handshake()
+		c.Close()
+	}()
+
+	rule := &HostPolicy{Fingerprint: fingerprintChrome, CertVerify: false}
+	ch := &clientHelloInfo{ALPN: []string{"http/1.1"}}
+	conn, _, err := upstreamHandshake(context.Background(), "www.example.com", "front.example.net", []string{ln.Addr().String()}, rule, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if sni := <-seen; sni != "front.example.net" {
+		t.Errorf("server saw SNI %q", sni)
+	}
+	if conn.negotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated %q, want http/1.1", conn.negotiatedProtocol)
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	strategyMITM     = "mitm"
+	strategyFragment = "fragment"
+
+	fragmentModeRecord = "record"
+	fragmentModeTCP    = "tcp"
+	fragmentModeBoth   = "both"
+)
+
+// FragmentOptions controls how the "fragment" strategy splits a ClientHello.
+type FragmentOptions struct {
+	// Mode is "record" (several TLS records, one write), "tcp" (original
+	// records split across TCP segments) or "both" (default).
+	Mode string `json:"mode"`
+	// Points are split offsets inside the SNI host name. Negative values count
+	// from the end of the name. Defaults to a single split in the middle.
+	Points []int `json:"points"`
+	// DelayMs is the pause between TCP segments, helping them leave as
+	// separate packets.
+	DelayMs int `json:"delay_ms"`
+}
+
+// sniSplitPoints returns the sorted, de-duplicated split offsets relative to
+// the handshake message, each strictly inside the SNI host name.
+func sniSplitPoints(ch *clientHelloInfo, opts *FragmentOptions) []int {
+	if ch.sniOffset < 0 || ch.sniLen < 2 {
+		return nil
+	}
+	points := []int{ch.sniLen / 2}
+	if opts != nil && len(opts.Points) > 0 {
+		points = points[:0]
+		for _, p := range opts.Points {
+			if p < 0 {
+				p += ch.sniLen
+			}
+			if p > 0 && p < ch.sniLen {
+				points = append(points, p)
+			}
+		}
+	}
+	sort.Ints(points)
+	var out []int
+	for _, p := range points {
+		if len(out) == 0 || out[len(out)-1] != ch.sniOffset+p {
+			out = append(out, ch.sniOffset+p)
+		}
+	}
+	return out
+}
+
+// fragmentClientHello splits a ClientHello into the chunks that should be
+// written upstream one after another. raw is the original record stream and
+// hello the reassembled handshake message. Bytes in raw past the handshake
+// (early data the client already sent) are appended to the last chunk.
+func fragmentClientHello(raw, hello []byte, ch *clientHelloInfo, opts *FragmentOptions) [][]byte {
+	points := sniSplitPoints(ch, opts)
+	if len(points) == 0 {
+		return [][]byte{raw}
+	}
+
+	mode := fragmentModeBoth
+	if opts != nil && opts.Mode != "" {
+		mode = opts.Mode
+	}
+
+	var chunks [][]byte
+	if mode == fragmentModeTCP {
+		// Keep the client's records intact and only cut the byte stream.
+		prev := 0
+		for _, p := range points {
+			off := handshakeToRecordOffset(raw, p)
+			if off <= prev {
+				continue
+			}
+			chunks = append(chunks, raw[prev:off])
+			prev = off
+		}
+		return append(chunks, raw[prev:])
+	}
+
+	// Re-frame the handshake message into one record per piece, reusing the
+	// record version of the client's first record.
+	version := raw[1:3]
+	prev := 0
+	for _, p := range append(points, len(hello)) {
+		piece := hello[prev:p]
+		rec := make([]byte, recordHeaderLen+len(piece))
+		rec[0] = recordTypeHandshake
+		copy(rec[1:3], version)
+		binary.BigEndian.PutUint16(rec[3:5], uint16(len(piece)))
+		copy(rec[recordHeaderLen:], piece)
+		chunks = append(chunks, rec)
+		prev = p
+	}
+	if tail := recordStreamLen(raw, len(hello)); tail < len(raw) {
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], raw[tail:]...)
+	}
+
+	if mode == fragmentModeRecord {
+		var joined []byte
+		for _, c := range chunks {
+			joined = append(joined, c...)
+		}
+		return [][]byte{joined}
+	}
+	return chunks
+}
+
+// recordStreamLen returns how many bytes of raw are taken up by the records
+// carrying the first n handshake bytes.
+func recordStreamLen(raw []byte, n int) int {
+	pos := 0
+	for pos+recordHeaderLen <= len(raw) && n > 0 {
+		recLen := int(binary.BigEndian.Uint16(raw[pos+3 : pos+5]))
+		n -= recLen
+		pos += recordHeaderLen + recLen
+	}
+	return min(pos, len(raw))
+}
+
+// forwardFragmented relays a TLS connection end-to-end like forwardDirect,
+// but sends the buffered ClientHello in fragments so on-path DPI can't read
+// the SNI from a single packet.
+func forwardFragmented(localConn net.Conn, targets []string, raw, hello []byte, ch *clientHelloInfo, opts *FragmentOptions) {
+	chunks := fragmentClientHello(raw, hello, ch, opts)
+	var delay time.Duration
+	if opts != nil && opts.DelayMs > 0 {
+		delay = time.Duration(opts.DelayMs) * time.Millisecond
+	}
+	LogDebug("Fragment: Sending ClientHello for %s in %d chunks", strings.Join(targets, ", "), len(chunks))
+	forwardDirectSegments(localConn, targets, chunks, delay)
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFragmentClientHello(t *testing.T) {
+	const name = "blocked.example.com"
+	raw := captureClientHello(t, name, []string{"h2"})
+	hello := raw[recordHeaderLen:]
+	ch, err := parseClientHello(hello)
+	if err != nil {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+
+	for _, opts := range []*FragmentOptions{
+		nil,
+		{Mode: fragmentModeRecord, Points: []int{3, -4}},
+		{Mode: fragmentModeTCP, Points: []int{1}},
+		{Mode: fragmentModeBoth, Points: []int{0, 100, 5, 5}},
+	} {
+		chunks := fragmentClientHello(raw, hello, ch, opts)
+		var wire []byte
+		for _, c := range chunks {
+			wire = append(wire, c...)
+		}
+		if len(chunks) == 1 && (opts == nil || opts.Mode != fragmentModeRecord) {
+			t.Fatalf("%+v: expected several chunks", opts)
+		}
+		if opts != nil && opts.Mode != fragmentModeRecord {
+			for _, c := range chunks {
+				if bytes.Contains(c, []byte(name)) {
+					t.Fatalf("%+v: chunk still carries the full SNI", opts)
+				}
+			}
+		}
+		if opts != nil && opts.Mode == fragmentModeTCP && !bytes.Equal(wire, raw) {
+			t.Fatalf("tcp mode must not alter the record stream")
+		}
+
+		client, server := net.Pipe()
+		go client.Write(wire)
+		_, got, err := readClientHello(server)
+		server.Close()
+		if err != nil {
+			t.Fatalf("%+v: readClientHello: %v", opts, err)
+		}
+		if !bytes.Equal(got, hello) {
+			t.Fatalf("%+v: reassembled ClientHello differs from original", opts)
+		}
+	}
+}
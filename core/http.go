@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHTTPHeadLen caps how much of a plain HTTP request is buffered while
+	// looking for the Host header.
+	maxHTTPHeadLen  = 16 * 1024
+	httpReadTimeout = 5 * time.Second
+)
+
+// readHTTPHead reads from conn until the end of the request header block
+// (or maxHTTPHeadLen) and returns every byte consumed.
+func readHTTPHead(conn net.Conn) ([]byte, error) {
+	buf := make([]byte, 0, 4096)
+	chunk := make([]byte, 4096)
+	for len(buf) < maxHTTPHeadLen {
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if bytes.Contains(buf, []byte("\r\n\r\n")) {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// parseHTTPHost returns the host (without port) of the request in head.
+func parseHTTPHost(head []byte) string {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// handleHTTPConnection applies hosts and alter_hostname rules to plain
+// HTTP/1.x traffic. The Host header picks the rule; matched requests are
+// dialed at the rule's target IP, and rules with UpgradeHTTPS carry the
+// stream over TLS to port 443 so SNI rewriting applies as for HTTPS.
+func handleHTTPConnection(localConn net.Conn, targetAddr string) {
+	defer func() {
+		if r := recover(); r != nil {
+			LogError("PANIC in handleHTTPConnection: %v", r)
+		}
+		localConn.Close()
+	}()
+
+	localConn.SetReadDeadline(time.Now().Add(httpReadTimeout))
+	head, err := readHTTPHead(localConn)
+	localConn.SetReadDeadline(time.Time{})
+	if len(head) == 0 {
+		LogDebug("HTTP: Read failed for %s: %v", targetAddr, err)
+		return
+	}
+
+	host := parseHTTPHost(head)
+	if host == "" {
+		LogDebug("HTTP: No Host header for %s, forwarding as-is", targetAddr)
+		forwardDirect(localConn, targetAddr, head)
+		return
+	}
+
+	matchedRule := globalEngine.Match(host)
+	if matchedRule == nil {
+		LogInfo("HTTP Direct: %s", host)
+		forwardDirect(localConn, targetAddr, head)
+		return
+	}
+
+	if !matchedRule.UpgradeHTTPS {
+		targets := resolveRuleTargets("HTTP", host, targetAddr, matchedRule)
+		forwardDirectSegments(localConn, targets, [][]byte{head}, 0)
+		return
+	}
+
+	origHost, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		origHost = targetAddr
+	}
+	targets := resolveRuleTargets("HTTP", host, net.JoinHostPort(origHost, "443"), matchedRule)
+	targetSNI := host
+	if matchedRule.TargetSNI != nil {
+		targetSNI = *matchedRule.TargetSNI
+	}
+
+	tlsRemote, actualTarget, err := upstreamHandshake(context.Background(), host, targetSNI, targets, matchedRule, nil)
+	if err != nil {
+		return
+	}
+	defer tlsRemote.Close()
+	LogInfo("HTTP Upgrade: %s -> https://%s (SNI: %s)", host, actualTarget, targetSNI)
+	if _, err := tlsRemote.Write(head); err != nil {
+		LogError("Failed to write request to %s: %v", actualTarget, err)
+		return
+	}
+
+	stats := relay(localConn, tlsRemote, tcpRelayIdle)
+	LogInfo("HTTP Upgrade closed: %s -> %s: %s", host, actualTarget, stats)
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseHTTPHost(t *testing.T) {
+	tests := []struct {
+		head string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: Example.COM\r\n\r\n", "example.com"},
+		{"POST /x HTTP/1.1\r\nHost: example.com:8080\r\nContent-Length: 3\r\n\r\nabc", "example.com"},
+		{"GET http://proxy.example.com/ HTTP/1.1\r\nHost: proxy.example.com.\r\n\r\n", "proxy.example.com"},
+		{"GET / HTTP/1.0\r\n\r\n", ""},
+		{"\x16\x03\x01\x00\x05hello", ""},
+	}
+	for _, tt := range tests {
+		if got := parseHTTPHost([]byte(tt.head)); got != tt.want {
+			t.Errorf("parseHTTPHost(%q) = %q, want %q", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestReadHTTPHeadSplit(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHo"))
+		client.Write([]byte("st: split.example.com\r\n\r\nbody"))
+	}()
+	head, err := readHTTPHead(server)
+	if err != nil {
+		t.Fatalf("readHTTPHead: %v", err)
+	}
+	if got := parseHTTPHost(head); got != "split.example.com" {
+		t.Fatalf("host = %q", got)
+	}
+}
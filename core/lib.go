@@ -2,7 +2,6 @@ package core
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -124,6 +123,10 @@ func StartEngine(fd int, configStr string, cb EngineCallbacks) {
 	if err != nil {
 		LogError("CORE: Engine Init Error: %v", err)
 	}
+	if err := ReloadTrustStore(); err != nil {
+		LogWarn("CORE: %v", err)
+	}
+	startProber(config)
 
 	ts, err := NewTunStack(fd, config, cb)
 	if err != nil {
@@ -135,6 +138,8 @@ func StartEngine(fd int, configStr string, cb EngineCallbacks) {
 }
 
 func StopEngine() {
+	stopProber()
+
 	if speedTicker != nil {
 		speedTicker.Stop()
 		close(speedStop)
@@ -219,8 +224,10 @@ func UpdateRules(configStr string) error {
 
 	globalEngine.mu.Lock()
 	globalEngine.rules = baseRules
+	globalEngine.userRules = config.Rules
 	globalEngine.mu.Unlock()
 	LogInfo("CORE: Rules updated (%d alter rules, %d cert verify rules)", len(userAlterHostname), len(userCertVerify))
+	ProbeNow()
 	return nil
 }
 
@@ -244,18 +251,19 @@ func FetchRemote(urlStr string) (string, error) {
 		}
 		hostname := u.Hostname()
 
-		var targetSNI, targetIP string
+		var targetSNI string
+		var targetIPs []string
 		rule := globalEngine.Match(hostname)
 		if rule != nil {
 			if rule.TargetSNI != nil {
 				targetSNI = *rule.TargetSNI
-				LogInfo("FetchRemote: Using rule SNI: %s for %s", targetSNI, hostname)
+				LogInfo("FetchRemote: Using rule SNI: %s for %s (%s)", targetSNI, hostname, rule.SNIPattern)
 			} else {
 				targetSNI = hostname
 			}
 			if rule.TargetIP != nil {
-				targetIP = *rule.TargetIP
-				LogInfo("FetchRemote: Using rule IP: %s for %s", targetIP, hostname)
+				targetIPs = resolveTargetIPs(context.Background(), *rule.TargetIP)
+				LogInfo("FetchRemote: Using rule IP: %v for %s (%s)", targetIPs, hostname, rule.IPPattern)
 			}
 		} else {
 			targetSNI = hostname
@@ -264,22 +272,22 @@ func FetchRemote(urlStr string) (string, error) {
 		dialer := getProtectedDialer()
 		transport := &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				actualAddr := addr
-				if targetIP != "" {
-					_, port, err := net.SplitHostPort(addr)
-					if err == nil {
-						actualAddr = net.JoinHostPort(targetIP, port)
-					} else {
-						actualAddr = net.JoinHostPort(targetIP, "443")
-					}
-					LogDebug("FetchRemote: Overriding IP %s -> %s", addr, actualAddr)
+				if len(targetIPs) == 0 {
+					return dialer.DialContext(ctx, network, addr)
 				}
-				return dialer.DialContext(ctx, network, actualAddr)
-			},
-			TLSClientConfig: &tls.Config{
-				ServerName:         targetSNI,
-				InsecureSkipVerify: true,
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					port = "443"
+				}
+				addrs := make([]string, len(targetIPs))
+				for i, ip := range targetIPs {
+					addrs[i] = net.JoinHostPort(ip, port)
+				}
+				LogDebug("FetchRemote: Overriding IP %s -> %v", addr, addrs)
+				conn, _, err := dialTargets(ctx, addrs)
+				return conn, err
 			},
+			TLSClientConfig: upstreamTLSConfig(hostname, targetSNI, rule),
 		}
 		client.Transport = transport
 
@@ -0,0 +1,323 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeStatusOK        = "ok"
+	probeStatusTCPFailed = "tcp_failed"
+	probeStatusTLSFailed = "tls_failed"
+
+	defaultProbeInterval = 10 * time.Minute
+	probeTimeout         = 5 * time.Second
+	maxConcurrentProbes  = 8
+)
+
+// ProbeResult is the latest health check of one front IP.
+type ProbeResult struct {
+	IP        string   `json:"ip"`
+	SNI       string   `json:"sni"`
+	Patterns  []string `json:"patterns"`
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	TCPMs     int64    `json:"tcp_ms"`
+	TLSMs     int64    `json:"tls_ms"`
+	CheckedAt int64    `json:"checked_at"` // unix seconds
+}
+
+// frontProber periodically checks the candidate IPs of every user rule with
+// a TargetIP and of every hosts entry, so the dial path can try the fastest
+// healthy front first.
+type frontProber struct {
+	mu      sync.RWMutex
+	results map[string]*ProbeResult // by IP
+
+	interval time.Duration
+	trigger  chan struct{}
+	stop     chan struct{}
+}
+
+var (
+	proberMu     sync.Mutex
+	activeProber *frontProber
+)
+
+func startProber(cfg *Config) {
+	interval := defaultProbeInterval
+	if cfg != nil && cfg.ProbeInterval != 0 {
+		if cfg.ProbeInterval < 0 {
+			LogInfo("Probe: Disabled")
+			return
+		}
+		interval = time.Duration(cfg.ProbeInterval) * time.Second
+	}
+
+	p := &frontProber{
+		results:  make(map[string]*ProbeResult),
+		interval: interval,
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	proberMu.Lock()
+	if activeProber != nil {
+		close(activeProber.stop)
+	}
+	activeProber = p
+	proberMu.Unlock()
+
+	go p.loop()
+}
+
+func stopProber() {
+	proberMu.Lock()
+	if activeProber != nil {
+		close(activeProber.stop)
+		activeProber = nil
+	}
+	proberMu.Unlock()
+}
+
+func currentProber() *frontProber {
+	proberMu.Lock()
+	defer proberMu.Unlock()
+	return activeProber
+}
+
+func (p *frontProber) loop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.probeAll()
+		select {
+		case <-ticker.C:
+		case <-p.trigger:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// probeTarget is one IP to check, with the SNI its rule would send.
+type probeTarget struct {
+	ip       string
+	sni      string
+	patterns []string
+}
+
+// probeTargets lists the IPs of user rules with a TargetIP, then those of the
+// hosts table (which also holds the built-in rules), each IP once. A hosts
+// entry is probed with the SNI alterHostname gives its pattern, if any.
+func probeTargets(rules []Rule, hosts, alterHostname map[string]string) []probeTarget {
+	var targets []probeTarget
+	seen := make(map[string]bool)
+	add := func(targetIP, sni string, patterns []string) {
+		for _, ip := range resolveTargetIPs(context.Background(), targetIP) {
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			targets = append(targets, probeTarget{ip: ip, sni: sni, patterns: patterns})
+		}
+	}
+	for _, r := range rules {
+		if r.TargetIP == nil || len(r.Patterns) == 0 {
+			continue
+		}
+		add(*r.TargetIP, probeSNI(&r), r.Patterns)
+	}
+
+	patterns := make([]string, 0, len(hosts))
+	for pattern := range hosts {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if hosts[pattern] == "" {
+			continue
+		}
+		r := Rule{Patterns: []string{pattern}}
+		if sni, ok := alterHostname[pattern]; ok {
+			r.TargetSNI = &sni
+		}
+		add(hosts[pattern], probeSNI(&r), r.Patterns)
+	}
+	return targets
+}
+
+// probeSNI returns the server name a rule sends upstream: its TargetSNI, or
+// else the first of its patterns that names a concrete host.
+func probeSNI(r *Rule) string {
+	if r.TargetSNI != nil {
+		return *r.TargetSNI
+	}
+	for _, pattern := range r.Patterns {
+		host := strings.TrimPrefix(pattern, "*.")
+		if !strings.ContainsAny(host, "*?$^") {
+			return host
+		}
+	}
+	return ""
+}
+
+func (p *frontProber) probeAll() {
+	globalEngine.mu.RLock()
+	rules := globalEngine.userRules
+	var hosts, alterHostname map[string]string
+	if globalEngine.rules != nil {
+		hosts = globalEngine.rules.Hosts
+		alterHostname = globalEngine.rules.AlterHostname
+	}
+	globalEngine.mu.RUnlock()
+
+	targets := probeTargets(rules, hosts, alterHostname)
+	if len(targets) == 0 {
+		return
+	}
+	LogDebug("Probe: Checking %d front IPs", len(targets))
+
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	fresh := make(map[string]*ProbeResult, len(targets))
+	var freshMu sync.Mutex
+	for _, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t probeTarget) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res := probeFront(t)
+			freshMu.Lock()
+			fresh[t.ip] = res
+			freshMu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	p.results = fresh
+	p.mu.Unlock()
+}
+
+// probeFront times a TCP connect and a TLS handshake to ip:443. The
+// certificate isn't verified: this measures reachability, and the real
+// connection applies the rule's cert_verify policy.
+func probeFront(t probeTarget) *ProbeResult {
+	res := &ProbeResult{IP: t.ip, SNI: t.sni, Patterns: t.patterns, CheckedAt: time.Now().Unix()}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := getProtectedDialer().DialContext(ctx, "tcp", net.JoinHostPort(t.ip, "443"))
+	if err != nil {
+		res.Status, res.Error = probeStatusTCPFailed, err.Error()
+		LogDebug("Probe: %s TCP failed: %v", t.ip, err)
+		return res
+	}
+	defer conn.Close()
+	res.TCPMs = time.Since(start).Milliseconds()
+
+	start = time.Now()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: t.sni, InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		res.Status, res.Error = probeStatusTLSFailed, err.Error()
+		LogDebug("Probe: %s TLS failed (SNI: %s): %v", t.ip, t.sni, err)
+		return res
+	}
+	res.TLSMs = time.Since(start).Milliseconds()
+	res.Status = probeStatusOK
+	LogDebug("Probe: %s ok (SNI: %s, tcp %dms, tls %dms)", t.ip, t.sni, res.TCPMs, res.TLSMs)
+	return res
+}
+
+// rank orders ips by probe result: healthy IPs by latency, then unprobed
+// ones in their original order, then failed ones.
+func (p *frontProber) rank(ips []string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	score := func(ip string) (int, int64) {
+		r := p.results[ip]
+		switch {
+		case r == nil:
+			return 1, 0
+		case r.Status == probeStatusOK:
+			return 0, r.TCPMs + r.TLSMs
+		default:
+			return 2, 0
+		}
+	}
+	ranked := append([]string(nil), ips...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ci, li := score(ranked[i])
+		cj, lj := score(ranked[j])
+		if ci != cj {
+			return ci < cj
+		}
+		return li < lj
+	})
+	return ranked
+}
+
+func (p *frontProber) snapshot() []ProbeResult {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make([]ProbeResult, 0, len(p.results))
+	for _, r := range p.results {
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SNI != out[j].SNI {
+			return out[i].SNI < out[j].SNI
+		}
+		return out[i].IP < out[j].IP
+	})
+	return out
+}
+
+// rankTargetIPs puts the best-performing front IPs first, when the prober
+// has results for them.
+func rankTargetIPs(ips []string) []string {
+	if p := currentProber(); p != nil && len(ips) > 1 {
+		return p.rank(ips)
+	}
+	return ips
+}
+
+// GetProbeResults returns the latest front IP health checks as a JSON array
+// of ProbeResult, for the UI.
+func GetProbeResults() string {
+	var results []ProbeResult
+	if p := currentProber(); p != nil {
+		results = p.snapshot()
+	}
+	if results == nil {
+		results = []ProbeResult{}
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// ProbeNow starts a health check round without waiting for the next tick.
+func ProbeNow() {
+	p := currentProber()
+	if p == nil {
+		return
+	}
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrontProberRank(t *testing.T) {
+	p := &frontProber{results: map[string]*ProbeResult{
+		"192.0.2.1": {Status: probeStatusTCPFailed},
+		"192.0.2.2": {Status: probeStatusOK, TCPMs: 80, TLSMs: 90},
+		"192.0.2.3": {Status: probeStatusOK, TCPMs: 20, TLSMs: 30},
+	}}
+	got := p.rank([]string{"192.0.2.1", "192.0.2.4", "192.0.2.2", "192.0.2.3"})
+	want := []string{"192.0.2.3", "192.0.2.2", "192.0.2.4", "192.0.2.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("rank = %v, want %v", got, want)
+	}
+}
+
+func TestProbeSNI(t *testing.T) {
+	front := "front.example.net"
+	empty := ""
+	for _, tc := range []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{Patterns: []string{"*.example.com"}, TargetSNI: &front}, front},
+		{Rule{Patterns: []string{"*.example.com"}, TargetSNI: &empty}, ""},
+		{Rule{Patterns: []string{"*.example.com"}}, "example.com"},
+		{Rule{Patterns: []string{"img*.example.com", "example.org"}}, "example.org"},
+	} {
+		if got := probeSNI(&tc.rule); got != tc.want {
+			t.Errorf("probeSNI(%v) = %q, want %q", tc.rule.Patterns, got, tc.want)
+		}
+	}
+}
+
+func TestProbeTargetsIncludesHostsTable(t *testing.T) {
+	front, ip := "front.example.net", "192.0.2.1"
+	rules := []Rule{{Patterns: []string{"*.example.com"}, TargetSNI: &front, TargetIP: &ip}}
+	hosts := map[string]string{
+		"*.example.com": "192.0.2.1",
+		"example.org":   "192.0.2.2",
+		"*.example.net": "192.0.2.3",
+	}
+	alter := map[string]string{"*.example.net": "cdn.example.net"}
+
+	var got []probeTarget
+	for _, target := range probeTargets(rules, hosts, alter) {
+		target.patterns = nil
+		got = append(got, target)
+	}
+	want := []probeTarget{
+		{ip: "192.0.2.1", sni: front},
+		{ip: "192.0.2.3", sni: "cdn.example.net"},
+		{ip: "192.0.2.2", sni: "example.org"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("probeTargets = %+v, want %+v", got, want)
+	}
+}
+
+func TestProbeRanksHostsTableIPs(t *testing.T) {
+	if _, err := InitEngine(`{}`, nil); err != nil {
+		t.Fatal(err)
+	}
+	globalEngine.mu.Lock()
+	globalEngine.rules.Hosts["hosts-only.probe-test.invalid"] = "127.0.0.1"
+	globalEngine.mu.Unlock()
+
+	p := &frontProber{results: map[string]*ProbeResult{}}
+	p.probeAll()
+	if p.results["127.0.0.1"] == nil {
+		t.Fatalf("hosts entry not probed: %v", p.results)
+	}
+	// Nothing may be listening on port 443 here; either way the result
+	// decides its place against an unprobed IP.
+	want := []string{"192.0.2.9", "127.0.0.1"}
+	if p.results["127.0.0.1"].Status == probeStatusOK {
+		want = []string{"127.0.0.1", "192.0.2.9"}
+	}
+	if got := p.rank([]string{"192.0.2.9", "127.0.0.1"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rank = %v, want %v (%s)", got, want, p.results["127.0.0.1"].Status)
+	}
+}
@@ -2,16 +2,19 @@ package core
 
 import (
 	"context"
-	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
-	"encoding/pem"
-	"fmt"
-	"io"
 	"net"
 	"strings"
 	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	checkHNAllow  = "allow"
+	checkHNDirect = "direct"
+	checkHNDrop   = "drop"
 )
 
 func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallbacks) {
@@ -32,18 +35,25 @@ func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallb
 		return
 	}
 
-	buf := make([]byte, 4096)
 	localConn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	n, err := localConn.Read(buf)
-	if err != nil {
-		LogDebug("HTTPS handshake read failed for %s: %v", targetAddr, err)
+	data, hello, readErr := readClientHello(localConn)
+	localConn.SetReadDeadline(time.Time{})
+	if len(data) == 0 {
+		LogDebug("HTTPS handshake read failed for %s: %v", targetAddr, readErr)
 		return
 	}
-	localConn.SetReadDeadline(time.Time{})
 
-	LogDebug("HTTPS: Read %d bytes from %s, first 16 bytes: %x", n, targetAddr, buf[:min(n, 16)])
-	sni, sniErr := parseSNI(buf[:n])
-	data := buf[:n]
+	LogDebug("HTTPS: Read %d bytes from %s, first 16 bytes: %x", len(data), targetAddr, data[:min(len(data), 16)])
+	var sni string
+	var ch *clientHelloInfo
+	sniErr := readErr
+	if sniErr == nil {
+		if ch, sniErr = parseClientHello(hello); sniErr == nil {
+			sni = ch.ServerName()
+			LogDebug("HTTPS: ClientHello from %s: version=%#04x, versions=%x, alpn=%v, groups=%v, ech=%v, psk=%v",
+				targetAddr, ch.Version, ch.SupportedVersions, ch.ALPN, ch.KeyShareGroups, ch.HasECH, ch.HasPSK)
+		}
+	}
 
 	if sniErr != nil {
 		LogDebug("HTTPS: SNI parse error for %s: %v", targetAddr, sniErr)
@@ -60,19 +70,32 @@ func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallb
 	}
 
 	// Peek rule match to see if interception is needed
-	var matchedRule *Rule
+	var matchedRule *HostPolicy
 	if sni != "" {
 		matchedRule = globalEngine.Match(sni)
 	}
 
-	actualTarget := targetAddr
+	if matchedRule != nil && sniErr == nil {
+		switch checkHostname(sni, targetAddr) {
+		case checkHNDirect:
+			LogInfo("HTTPS Direct: %s (check_hostname mismatch, rule not applied)", sni)
+			forwardDirect(localConn, targetAddr, data)
+			return
+		case checkHNDrop:
+			LogInfo("HTTPS Drop: %s (check_hostname mismatch)", sni)
+			return
+		}
+	}
+
+	targets := []string{targetAddr}
 	var targetSNI string = sni
 	var shouldMITM bool = false
+	var useFragment bool = false
 
 	if matchedRule != nil {
 		// Only MITM if SNI changed. If only TargetIP is present or TargetSNI matches original,
 		// we use forwardDirect to preserve end-to-end encryption and performance.
-		
+
 		sniChanged := false
 		if matchedRule.TargetSNI != nil {
 			targetSNI = *matchedRule.TargetSNI
@@ -81,7 +104,22 @@ func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallb
 			}
 		}
 
-		if sniChanged {
+		if matchedRule.Strategy == strategyFragment {
+			// Fragment keeps the original ClientHello, so the SNI is never
+			// rewritten and no MITM certificate is needed.
+			targetSNI = sni
+			useFragment = ch != nil
+			if useFragment {
+				LogInfo("HTTPS SNI: %s (FRAGMENT, NO MITM)", sni)
+			} else {
+				LogWarn("HTTPS SNI: %s (FRAGMENT unavailable without a parsed ClientHello, NO MITM)", sni)
+			}
+		} else if matchedRule.Strategy == strategyECH {
+			// ECH needs the plaintext to re-encrypt, so it's always a MITM;
+			// targetSNI is only used if ECH turns out to be unavailable.
+			shouldMITM = true
+			LogInfo("HTTPS SNI: %s (ECH, MITM REQUIRED)", sni)
+		} else if sniChanged {
 			shouldMITM = true
 			if targetSNI == "" {
 				LogInfo("HTTPS SNI: %s -> <STRIP> (MITM REQUIRED)", sni)
@@ -92,55 +130,7 @@ func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallb
 			LogInfo("HTTPS SNI: %s (SNI unchanged, NO MITM)", sni)
 		}
 
-		if matchedRule.TargetIP != nil && *matchedRule.TargetIP != "" {
-			host, port, err := net.SplitHostPort(targetAddr)
-			if err != nil {
-				host = targetAddr
-				port = "443"
-			}
-
-			resolvedIP := *matchedRule.TargetIP
-			if net.ParseIP(*matchedRule.TargetIP) == nil {
-				globalEngine.mu.RLock()
-				resolver := globalEngine.resolver
-				globalEngine.mu.RUnlock()
-				if resolver != nil {
-					if ip, err := resolver.Resolve(context.Background(), *matchedRule.TargetIP); err == nil {
-						resolvedIP = ip
-					}
-				}
-			}
-
-			if strings.Contains(resolvedIP, ":") && !strings.HasPrefix(resolvedIP, "[") {
-				actualTarget = "[" + resolvedIP + "]:" + port
-			} else {
-				actualTarget = net.JoinHostPort(resolvedIP, port)
-			}
-			LogInfo("HTTPS Redirect: %s -> %s", host, actualTarget)
-		} else {
-			// No explicit TargetIP, but we matched a rule.
-			// Re-resolve the SNI using trusted DNS to bypass potential DNS pollution.
-			globalEngine.mu.RLock()
-			resolver := globalEngine.resolver
-			globalEngine.mu.RUnlock()
-			if resolver != nil {
-				LogDebug("Re-resolving SNI '%s' using trusted DNS", sni)
-				if ip, err := resolver.Resolve(context.Background(), sni); err == nil {
-					_, port, err := net.SplitHostPort(targetAddr)
-					if err != nil {
-						port = "443"
-					}
-					if strings.Contains(ip, ":") && !strings.HasPrefix(ip, "[") {
-						actualTarget = "[" + ip + "]:" + port
-					} else {
-						actualTarget = net.JoinHostPort(ip, port)
-					}
-					LogInfo("HTTPS Re-resolved: %s -> %s (Trusted DNS)", sni, actualTarget)
-				} else {
-					LogWarn("Failed to re-resolve '%s': %v. Using original IP.", sni, err)
-				}
-			}
-		}
+		targets = resolveRuleTargets("HTTPS", sni, targetAddr, matchedRule)
 	} else if sni != "" {
 		LogInfo("HTTPS Direct: %s", sni)
 	}
@@ -152,34 +142,43 @@ func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallb
 			return
 		}
 
-		if targetSNI == "" {
-			LogDebug("TLS Client: Stripping SNI extension for connection to %s", actualTarget)
-		} else {
-			LogDebug("TLS Client: Setting SNI to '%s' for connection to %s", targetSNI, actualTarget)
-		}
-
-		certBytes, key, err := certManager.SignLeafCert([]string{sni})
+		cert, err := certManager.GetLeafCert([]string{sni})
 		if err != nil {
 			LogError("Failed to sign cert for %s: %v", sni, err)
 			return
 		}
-		LogDebug("Signed leaf cert for %s, len: %d", sni, len(certBytes))
 
-		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
-		keyPEM := pemEncodeKey(key)
-		if len(certPEM) == 0 || len(keyPEM) == 0 {
-			LogError("Failed to PEM encode cert or key for %s", sni)
-			return
+		// Offer the client's ALPN list upstream so the server, not us, picks the
+		// protocol; the local handshake then mirrors its choice.
+		var tlsRemote *upstreamConn
+		var actualTarget string
+		if matchedRule.Strategy == strategyECH {
+			tlsRemote, actualTarget, err = echHandshake(context.Background(), sni, targets, matchedRule, ch)
+			if err == nil {
+				LogDebug("HTTPS ECH: %s accepted by %s", sni, actualTarget)
+			} else if targetSNI == sni {
+				LogWarn("HTTPS ECH: %s unavailable (%v), no target_sni to fall back to; sending the SNI in the clear", sni, err)
+			} else {
+				LogWarn("HTTPS ECH: %s unavailable (%v), falling back to SNI rewrite", sni, err)
+			}
+		}
+		if tlsRemote == nil {
+			if matchedRule.Adaptive {
+				tlsRemote, actualTarget, targetSNI, err = adaptiveHandshake(sni, targetSNI, targets, matchedRule, ch)
+			} else {
+				tlsRemote, actualTarget, err = upstreamHandshake(context.Background(), sni, targetSNI, targets, matchedRule, ch)
+			}
 		}
-
-		cert, err := tls.X509KeyPair(certPEM, keyPEM)
 		if err != nil {
-			LogError("Failed to create X509KeyPair for %s: %v (CertLen: %d, KeyLen: %d)", sni, err, len(certPEM), len(keyPEM))
 			return
 		}
 
+		negotiated := tlsRemote.negotiatedProtocol
 		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			Certificates: []tls.Certificate{*cert},
+		}
+		if negotiated != "" {
+			tlsConfig.NextProtos = []string{negotiated}
 		}
 
 		prefixConn := &PrefixConn{Conn: localConn, Prefix: data}
@@ -187,82 +186,249 @@ func handleProxyConnection(localConn net.Conn, targetAddr string, cb EngineCallb
 
 		if err := tlsLocal.Handshake(); err != nil {
 			LogError("Client TLS handshake failed for %s: %v", sni, err)
+			tlsRemote.Close()
 			return
 		}
 
-		dialer := getProtectedDialer()
-		rawRemote, err := dialer.Dial("tcp", actualTarget)
+		defer tlsRemote.Close()
+		LogDebug("MITM tunnel established: %s -> %s (SNI: %s, ALPN: %q)", sni, actualTarget, targetSNI, negotiated)
+		stats := relay(tlsLocal, tlsRemote, tcpRelayIdle)
+		LogInfo("MITM tunnel closed: %s -> %s: %s", sni, actualTarget, stats)
+
+	} else if useFragment {
+		forwardFragmented(localConn, targets, data, hello, ch, matchedRule.Fragment)
+	} else {
+		forwardDirectSegments(localConn, targets, [][]byte{data}, 0)
+	}
+}
+
+// upstreamHandshake dials the first reachable of targets and completes a TLS
+// handshake sending targetSNI, verified per the cert_verify policy for host.
+// The client's ALPN list (from ch) is offered upstream, and the rule's
+// fingerprint picks the ClientHello layout. Failures are logged here.
+func upstreamHandshake(ctx context.Context, host, targetSNI string, targets []string, rule *HostPolicy, ch *clientHelloInfo) (*upstreamConn, string, error) {
+	var alpn []string
+	if ch != nil {
+		alpn = ch.ALPN
+	}
+	var spec *utls.ClientHelloSpec
+	if rule != nil && rule.Fingerprint != "" {
+		var err error
+		if spec, err = fingerprintSpec(rule.Fingerprint, targetSNI, alpn, ch); err != nil {
+			LogWarn("TLS Client: Fingerprint %q unavailable for %s, using Go's: %v", rule.Fingerprint, host, err)
+		}
+	}
+
+	rawRemote, actualTarget, err := dialTargets(ctx, targets)
+	if err != nil {
+		LogError("Failed to dial %s: %v", strings.Join(targets, ", "), err)
+		return nil, "", err
+	}
+
+	if targetSNI == "" {
+		LogDebug("TLS Client: Stripping SNI extension for connection to %s", actualTarget)
+	} else {
+		LogDebug("TLS Client: Setting SNI to '%s' for connection to %s", targetSNI, actualTarget)
+	}
+
+	remoteTLSConfig := upstreamTLSConfig(host, targetSNI, rule)
+	remoteTLSConfig.NextProtos = alpn
+
+	if spec != nil {
+		LogDebug("TLS Client: Using %s fingerprint for %s", rule.Fingerprint, actualTarget)
+		conn, err := utlsHandshake(ctx, rawRemote, remoteTLSConfig, spec)
 		if err != nil {
-			LogError("Failed to dial %s: %v", actualTarget, err)
-			return
+			LogError("Server TLS handshake failed for %s (SNI: %s): %v", actualTarget, targetSNI, err)
+			rawRemote.Close()
+			return nil, actualTarget, err
 		}
+		return conn, actualTarget, nil
+	}
+
+	tlsRemote := tls.Client(rawRemote, remoteTLSConfig)
+	if err := tlsRemote.HandshakeContext(ctx); err != nil {
+		LogError("Server TLS handshake failed for %s (SNI: %s): %v", actualTarget, targetSNI, err)
+		logRemoteCertificate(actualTarget, tlsRemote.ConnectionState().PeerCertificates)
+		rawRemote.Close()
+		return nil, actualTarget, err
+	}
+	return &upstreamConn{Conn: tlsRemote, negotiatedProtocol: tlsRemote.ConnectionState().NegotiatedProtocol}, actualTarget, nil
+}
+
+// logRemoteCertificate logs what the server presented before a failed
+// handshake.
+func logRemoteCertificate(addr string, certs []*x509.Certificate) {
+	if len(certs) > 0 {
+		cert := certs[0]
+		LogError("Remote Certificate details: Subject='%s', Issuer='%s', DNSNames=%v, NotAfter=%s",
+			cert.Subject, cert.Issuer, cert.DNSNames, cert.NotAfter)
+	} else {
+		LogError("No remote certificate received from %s (Handshake aborted by server or before cert exchange)", addr)
+	}
+}
+
+// checkHostname verifies, when check_hostname is enabled, that the original
+// destination of a connection is one of the addresses the configured
+// nameservers (or a hosts rule) give for sni. This keeps rewrite rules from
+// being used to reach arbitrary IPs. The system resolver is never asked, and
+// a failed lookup counts as a mismatch. It returns "" when the rule may be
+// applied, otherwise the configured mismatch policy.
+func checkHostname(sni, targetAddr string) string {
+	globalEngine.mu.RLock()
+	cfg := globalEngine.config
+	resolver := globalEngine.resolver
+	globalEngine.mu.RUnlock()
+
+	if cfg == nil || !cfg.CheckHN || resolver == nil {
+		return ""
+	}
+
+	policy := strings.ToLower(cfg.CheckHNPolicy)
+	if policy != checkHNAllow && policy != checkHNDrop {
+		policy = checkHNDirect
+	}
+
+	host, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		host = targetAddr
+	}
+	destIP := net.ParseIP(host)
+	if destIP == nil {
+		return ""
+	}
 
-		remoteTLSConfig := &tls.Config{
-			ServerName: targetSNI,
-		}
-
-		verify := matchedRule.CertVerify
-		if verify == nil {
-			verify = globalEngine.MatchCertVerify(sni)
-		}
-
-		if verify != nil {
-			switch v := verify.(type) {
-			case bool:
-				if !v {
-					LogInfo("TLS Client: Verification DISABLED for %s", sni)
-					remoteTLSConfig.InsecureSkipVerify = true
-				}
-			case string:
-				vLower := strings.ToLower(v)
-				if vLower == "false" {
-					LogInfo("TLS Client: Verification DISABLED for %s", sni)
-					remoteTLSConfig.InsecureSkipVerify = true
-				} else if vLower == "strict" || vLower == "true" {
-					LogInfo("TLS Client: Strict verification for %s (using SNI %s)", sni, targetSNI)
-				} else {
-					LogInfo("TLS Client: Loose verification for %s (trusting SNI %s)", sni, v)
-					remoteTLSConfig.InsecureSkipVerify = true
-					remoteTLSConfig.VerifyConnection = func(cs tls.ConnectionState) error {
-						opts := x509.VerifyOptions{
-							DNSName:       v,
-							Intermediates: x509.NewCertPool(),
-						}
-						for _, cert := range cs.PeerCertificates[1:] {
-							opts.Intermediates.AddCert(cert)
-						}
-						_, err := cs.PeerCertificates[0].Verify(opts)
-						return err
-					}
-				}
+	ips, err := resolver.resolveTrusted(context.Background(), sni)
+	if err != nil {
+		LogWarn("CheckHN: Cannot verify %s -> %s: %v (policy: %s)", sni, host, err, policy)
+	} else {
+		for _, ip := range ips {
+			if destIP.Equal(net.ParseIP(ip)) {
+				LogDebug("CheckHN: %s -> %s verified", sni, host)
+				return ""
 			}
-		} else {
-			remoteTLSConfig.InsecureSkipVerify = true
 		}
+		LogWarn("CheckHN: %s does not resolve to %s (trusted: %v, policy: %s)", sni, host, ips, policy)
+	}
+	if policy == checkHNAllow {
+		return ""
+	}
+	return policy
+}
 
-		tlsRemote := tls.Client(rawRemote, remoteTLSConfig)
+// resolveRuleTargets returns the addresses a matched connection should be
+// dialed at: every entry of the rule's TargetIP if set, otherwise host
+// re-resolved through the trusted Resolver. It falls back to targetAddr, and
+// the port of targetAddr is kept throughout.
+func resolveRuleTargets(proto, host, targetAddr string, rule *HostPolicy) []string {
+	origHost, port, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		origHost = targetAddr
+		port = "443"
+	}
+	withPort := func(ips []string) []string {
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.JoinHostPort(ip, port)
+		}
+		return addrs
+	}
 
-		if err := tlsRemote.Handshake(); err != nil {
-			LogError("Server TLS handshake failed for %s (SNI: %s): %v", actualTarget, targetSNI, err)
-			state := tlsRemote.ConnectionState()
-			if len(state.PeerCertificates) > 0 {
-				cert := state.PeerCertificates[0]
-				LogError("Remote Certificate details: Subject='%s', Issuer='%s', DNSNames=%v, NotAfter=%s",
-					cert.Subject, cert.Issuer, cert.DNSNames, cert.NotAfter)
-			} else {
-				LogError("No remote certificate received from %s (Handshake aborted by server or before cert exchange)", actualTarget)
-			}
-			rawRemote.Close()
-			return
+	if rule.TargetIP != nil && *rule.TargetIP != "" {
+		if ips := resolveTargetIPs(context.Background(), *rule.TargetIP); len(ips) > 0 {
+			addrs := withPort(ips)
+			LogInfo("%s Redirect: %s -> %s", proto, origHost, strings.Join(addrs, ", "))
+			return addrs
 		}
+		LogWarn("%s: No usable target in '%s' for %s. Using original IP.", proto, *rule.TargetIP, host)
+		return []string{targetAddr}
+	}
 
-		LogDebug("MITM tunnel established: %s -> %s (SNI: %s)", sni, actualTarget, targetSNI)
-		go io.Copy(tlsRemote, tlsLocal)
-		io.Copy(tlsLocal, tlsRemote)
+	// No explicit TargetIP, but we matched a rule.
+	// Re-resolve the host using trusted DNS to bypass potential DNS pollution.
+	globalEngine.mu.RLock()
+	resolver := globalEngine.resolver
+	globalEngine.mu.RUnlock()
+	if resolver != nil {
+		LogDebug("Re-resolving '%s' using trusted DNS", host)
+		ips, err := resolver.ResolveAll(context.Background(), host)
+		if err == nil {
+			addrs := withPort(ips)
+			LogInfo("%s Re-resolved: %s -> %s (Trusted DNS)", proto, host, strings.Join(addrs, ", "))
+			return addrs
+		}
+		LogWarn("Failed to re-resolve '%s': %v. Using original IP.", host, err)
+	}
+	return []string{targetAddr}
+}
 
+// upstreamTLSConfig builds the client config for the upstream leg of an
+// intercepted connection, applying the cert_verify policy for host. Without
+// a policy the chain must be valid for host or for the SNI sent; only an
+// explicit false turns verification off.
+func upstreamTLSConfig(host, targetSNI string, rule *HostPolicy) *tls.Config {
+	remoteTLSConfig := &tls.Config{
+		ServerName: targetSNI,
+		RootCAs:    trustedRoots(),
+	}
+
+	var verify any
+	if rule != nil {
+		verify = rule.CertVerify
 	} else {
-		forwardDirect(localConn, actualTarget, data)
+		verify = globalEngine.MatchCertVerify(host)
 	}
+
+	var entries []string
+	switch v := verify.(type) {
+	case nil:
+		hosts := []string{host}
+		if targetSNI != "" && !strings.EqualFold(targetSNI, host) {
+			hosts = append(hosts, targetSNI)
+		}
+		remoteTLSConfig.InsecureSkipVerify = true
+		remoteTLSConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyCertEntries(cs.PeerCertificates, hosts, nil)
+		}
+	case bool:
+		if !v {
+			LogInfo("TLS Client: Verification DISABLED for %s", host)
+			remoteTLSConfig.InsecureSkipVerify = true
+		}
+	case string:
+		vLower := strings.ToLower(v)
+		if vLower == "false" {
+			LogInfo("TLS Client: Verification DISABLED for %s", host)
+			remoteTLSConfig.InsecureSkipVerify = true
+		} else if vLower == "strict" || vLower == "true" {
+			LogInfo("TLS Client: Strict verification for %s (using SNI %s)", host, targetSNI)
+		} else {
+			entries = []string{v}
+		}
+	case []any:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				entries = append(entries, s)
+			}
+		}
+	case []string:
+		entries = v
+	}
+
+	// Loose verification: the chain must be valid for one of the listed
+	// hosts or match one of the listed pins, whatever SNI was sent.
+	if len(entries) > 0 {
+		hosts, pins := splitCertVerifyEntries(entries)
+		if len(pins) > 0 {
+			LogInfo("TLS Client: Pinned verification for %s (%d pins, hosts %v)", host, len(pins), hosts)
+		} else {
+			LogInfo("TLS Client: Loose verification for %s (trusting SNI %v)", host, hosts)
+		}
+		remoteTLSConfig.InsecureSkipVerify = true
+		remoteTLSConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyCertEntries(cs.PeerCertificates, hosts, pins)
+		}
+	}
+	return remoteTLSConfig
 }
 
 func handleUDPForwardDirect(localConn net.Conn, targetAddr string) {
@@ -273,6 +439,12 @@ func handleUDPForwardDirect(localConn net.Conn, targetAddr string) {
 		localConn.Close()
 	}()
 
+	relayUDP(localConn, targetAddr, nil)
+}
+
+// relayUDP dials targetAddr, sends any datagrams already read from localConn
+// and then relays both directions until either side fails.
+func relayUDP(localConn net.Conn, targetAddr string, pending [][]byte) {
 	dialer := getProtectedDialer()
 	remote, err := dialer.Dial("udp", targetAddr)
 	if err != nil {
@@ -280,39 +452,49 @@ func handleUDPForwardDirect(localConn net.Conn, targetAddr string) {
 	}
 	defer remote.Close()
 
-	go io.Copy(remote, localConn)
-	io.Copy(localConn, remote)
+	for _, pkt := range pending {
+		if _, err := remote.Write(pkt); err != nil {
+			return
+		}
+	}
+
+	stats := relay(localConn, remote, udpRelayIdle)
+	LogDebug("UDP relay closed for %s: %s", targetAddr, stats)
 }
 
 func forwardDirect(localConn net.Conn, targetAddr string, prefixData []byte) {
-	dialer := getProtectedDialer()
-	remote, err := dialer.Dial("tcp", targetAddr)
+	forwardDirectSegments(localConn, []string{targetAddr}, [][]byte{prefixData}, 0)
+}
+
+// forwardDirectSegments dials the first reachable of targets, writes each
+// prefix segment with a separate Write (pausing delay in between), then
+// relays both directions.
+func forwardDirectSegments(localConn net.Conn, targets []string, segments [][]byte, delay time.Duration) {
+	remote, targetAddr, err := dialTargets(context.Background(), targets)
 	if err != nil {
-		LogError("Failed to connect to %s: %v", targetAddr, err)
+		LogError("Failed to connect to %s: %v", strings.Join(targets, ", "), err)
 		return
 	}
 	defer remote.Close()
 
-	if len(prefixData) > 0 {
-		if _, err := remote.Write(prefixData); err != nil {
+	if tcpConn, ok := remote.(*net.TCPConn); ok && len(segments) > 1 {
+		tcpConn.SetNoDelay(true)
+	}
+	for i, seg := range segments {
+		if len(seg) == 0 {
+			continue
+		}
+		if i > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := remote.Write(seg); err != nil {
 			LogError("Failed to write prefix data to %s: %v", targetAddr, err)
 			return
 		}
 	}
 
-	done := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(remote, localConn)
-		done <- err
-	}()
-	go func() {
-		_, err := io.Copy(localConn, remote)
-		done <- err
-	}()
-
-	if err := <-done; err != nil {
-		LogDebug("Connection closed for %s: %v", targetAddr, err)
-	}
+	stats := relay(localConn, remote, tcpRelayIdle)
+	LogInfo("Connection closed for %s: %s", targetAddr, stats)
 }
 
 type PrefixConn struct {
@@ -329,11 +511,6 @@ func (c *PrefixConn) Read(b []byte) (int, error) {
 	return c.Conn.Read(b)
 }
 
-func pemEncodeKey(key interface{}) []byte {
-	b, _ := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
-	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -341,67 +518,22 @@ func min(a, b int) int {
 	return b
 }
 
-func parseSNI(data []byte) (string, error) {
-	pos, err := findSNIPos(data)
-	if err != nil {
-		return "", err
-	}
-	if pos+3 > len(data) {
-		return "", fmt.Errorf("overflow")
-	}
-	nameLen := int(binary.BigEndian.Uint16(data[pos+1 : pos+3]))
-	if pos+3+nameLen > len(data) {
-		return "", fmt.Errorf("overflow")
-	}
-	return string(data[pos+3 : pos+3+nameLen]), nil
-}
-
-func findSNIPos(data []byte) (int, error) {
-	if len(data) < 43 {
-		return 0, fmt.Errorf("short")
-	}
-	pos := 9 + 2 + 32
-	sessionIDLen := int(data[pos])
-	pos += 1 + sessionIDLen
-	if pos+2 > len(data) {
-		return 0, fmt.Errorf("overflow")
-	}
-	cipherSuitesLen := int(binary.BigEndian.Uint16(data[pos : pos+2]))
-	pos += 2 + cipherSuitesLen
-	if pos+1 > len(data) {
-		return 0, fmt.Errorf("overflow")
-	}
-	compMethodsLen := int(data[pos])
-	pos += 1 + compMethodsLen
-	if pos+2 > len(data) {
-		return 0, fmt.Errorf("overflow")
-	}
-	extLen := int(binary.BigEndian.Uint16(data[pos : pos+2]))
-	pos += 2
-	end := pos + extLen
-	for pos+4 <= end && pos+4 <= len(data) {
-		extType := binary.BigEndian.Uint16(data[pos : pos+2])
-		extSize := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
-		pos += 4
-		if extType == 0x00 {
-			return pos + 2, nil
-		}
-		pos += extSize
-	}
-	return 0, fmt.Errorf("not found")
-}
-
-func tryModifySNI(data []byte, old, new string) []byte {
-	pos, err := findSNIPos(data)
-	if err != nil {
+// tryModifySNI rewrites the SNI in a raw ClientHello (raw records plus the
+// reassembled handshake from readClientHello) when the new name has the same
+// length as the old one, so no length fields need adjusting.
+func tryModifySNI(raw, hello []byte, newSNI string) []byte {
+	ch, err := parseClientHello(hello)
+	if err != nil || ch.sniOffset < 0 || len(newSNI) != ch.sniLen {
 		return nil
 	}
-	nameLen := int(binary.BigEndian.Uint16(data[pos+1 : pos+3]))
-	if len(new) == nameLen {
-		newData := make([]byte, len(data))
-		copy(newData, data)
-		copy(newData[pos+3:], []byte(new))
-		return newData
+	newData := make([]byte, len(raw))
+	copy(newData, raw)
+	for i := 0; i < len(newSNI); i++ {
+		pos := handshakeToRecordOffset(newData, ch.sniOffset+i)
+		if pos < 0 {
+			return nil
+		}
+		newData[pos] = newSNI[i]
 	}
-	return nil
+	return newData
 }
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// useTestCA installs a fresh MITM CA for the test and returns it with a pool
+// trusting it.
+func useTestCA(t *testing.T) (*CertManager, *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+	cm, err := NewCertManager(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCM := certManager
+	certManager = cm
+	t.Cleanup(func() {
+		certManager = oldCM
+		cm.Close()
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(cm.RootCert)
+	return cm, roots
+}
+
+func TestMITMMirrorsUpstreamALPN(t *testing.T) {
+	cm, roots := useTestCA(t)
+	upstreamCert, err := cm.GetLeafCert([]string{"front.alpn-test.invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitEngine(`{
+		"rules": [{"patterns": ["www.alpn-test.invalid"], "target_sni": "front.alpn-test.invalid", "target_ip": "127.0.0.1"}],
+		"cert_verify": [{"patterns": ["www.alpn-test.invalid"], "verify": false}]
+	}`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		upstream []string
+		client   []string
+		want     string
+	}{
+		{"upstream picks h2", []string{"h2", "http/1.1"}, []string{"h2", "http/1.1"}, "h2"},
+		{"upstream picks http/1.1", []string{"http/1.1"}, []string{"h2", "http/1.1"}, "http/1.1"},
+		{"client offers none", []string{"h2", "http/1.1"}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offered := make(chan []string, 1)
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+				Certificates: []tls.Certificate{*upstreamCert},
+				NextProtos:   tt.upstream,
+				GetConfigForClient: func(hi *tls.ClientHelloInfo) (*tls.Config, error) {
+					offered <- hi.SupportedProtos
+					return nil, nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.Read(make([]byte, 1))
+			}()
+
+			client, local := tcpPair(t)
+			done := make(chan struct{})
+			go func() {
+				handleProxyConnection(local, ln.Addr().String(), nil)
+				close(done)
+			}()
+
+			conn := tls.Client(client, &tls.Config{
+				ServerName: "www.alpn-test.invalid",
+				RootCAs:    roots,
+				NextProtos: tt.client,
+			})
+			if err := conn.Handshake(); err != nil {
+				t.Fatalf("client handshake: %v", err)
+			}
+			if got := conn.ConnectionState().NegotiatedProtocol; got != tt.want {
+				t.Errorf("client negotiated %q, want %q", got, tt.want)
+			}
+			if got := <-offered; len(got) != len(tt.client) {
+				t.Errorf("upstream was offered %v, want %v", got, tt.client)
+			}
+			// Send a byte so the proxy's handshake completes before hanging up.
+			conn.Write([]byte("x"))
+			conn.Close()
+			<-done
+		})
+	}
+}
+
+func TestCheckHostname(t *testing.T) {
+	trusted := &fakeBackend{answers: map[uint16][]string{dns.TypeA: {"192.0.2.1"}}}
+	failing := &scriptedBackend{}
+	failing.fail.Store(true)
+
+	tests := []struct {
+		policy  string
+		backend dnsBackend
+		dest    string
+		want    string
+	}{
+		{checkHNDirect, trusted, "192.0.2.1:443", ""},
+		{checkHNDirect, trusted, "198.51.100.1:443", checkHNDirect},
+		{checkHNDirect, failing, "192.0.2.1:443", checkHNDirect},
+		{checkHNDrop, trusted, "192.0.2.1:443", ""},
+		{checkHNDrop, trusted, "198.51.100.1:443", checkHNDrop},
+		{checkHNDrop, failing, "192.0.2.1:443", checkHNDrop},
+		{checkHNAllow, trusted, "198.51.100.1:443", ""},
+		{checkHNAllow, failing, "192.0.2.1:443", ""},
+	}
+	for _, tt := range tests {
+		if _, err := InitEngine(fmt.Sprintf(`{"check_hostname": true, "check_hostname_policy": %q}`, tt.policy), nil); err != nil {
+			t.Fatal(err)
+		}
+		globalEngine.mu.Lock()
+		globalEngine.resolver = newTestResolver(globalEngine.config, tt.backend)
+		globalEngine.mu.Unlock()
+
+		if got := checkHostname("www.checkhn-test.invalid", tt.dest); got != tt.want {
+			t.Errorf("policy %s, dest %s, failing %v: got %q, want %q", tt.policy, tt.dest, tt.backend == failing, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigVerifiesByDefault(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	// httptest's certificate is for example.com, from a root nobody trusts.
+	for _, tc := range []struct {
+		verify any
+		ok     bool
+	}{
+		{nil, false},
+		{true, false},
+		{false, true},
+		{"false", true},
+	} {
+		rule := &HostPolicy{CertVerify: tc.verify}
+		conn, _, err := upstreamHandshake(context.Background(), "example.com", "example.com", []string{addr}, rule, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("cert_verify %v: err %v", tc.verify, err)
+		}
+	}
+
+	if _, err := FetchRemote(srv.URL); err == nil {
+		t.Error("FetchRemote accepted an untrusted certificate")
+	}
+}
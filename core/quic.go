@@ -0,0 +1,362 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+
+	quicPolicyBlock = "block"
+	quicPolicyPass  = "pass"
+
+	// Chrome spreads large (post-quantum) ClientHellos over a few Initials.
+	maxQUICSniffPackets = 8
+	quicSniffTimeout    = 3 * time.Second
+	// How long a blocked flow keeps swallowing retransmits before closing.
+	quicBlockIdle = 30 * time.Second
+)
+
+var (
+	quicV1InitialSalt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicV2InitialSalt = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+
+	errNotQUICInitial = errors.New("not a QUIC Initial packet")
+)
+
+// quicInitialKeys holds the client Initial packet protection keys (RFC 9001
+// section 5.2), derived from the Destination Connection ID alone.
+type quicInitialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0) // empty context
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+func deriveQUICInitialKeys(version uint32, dcid []byte) (*quicInitialKeys, error) {
+	salt, prefix := quicV1InitialSalt, "quic "
+	if version == quicVersion2 {
+		salt, prefix = quicV2InitialSalt, "quicv2 "
+	}
+	initialSecret, err := hkdf.Extract(sha256.New, dcid, salt)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdfExpandLabel(clientSecret, prefix+"key", 16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdfExpandLabel(clientSecret, prefix+"iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := hkdfExpandLabel(clientSecret, prefix+"hp", 16)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialKeys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+// readQUICVarint decodes a variable-length integer (RFC 9000 section 16).
+func readQUICVarint(r *helloReader) (uint64, bool) {
+	first, ok := r.u8()
+	if !ok {
+		return 0, false
+	}
+	n := 1 << (first >> 6)
+	v := uint64(first & 0x3f)
+	rest, ok := r.bytes(n - 1)
+	if !ok {
+		return 0, false
+	}
+	for _, b := range rest {
+		v = v<<8 | uint64(b)
+	}
+	return v, true
+}
+
+// decryptQUICInitial removes header and packet protection from the first
+// packet in a client datagram and returns its plaintext frames.
+func decryptQUICInitial(datagram []byte) ([]byte, error) {
+	r := &helloReader{data: datagram}
+	first, ok := r.u8()
+	if !ok || first&0xc0 != 0xc0 {
+		return nil, errNotQUICInitial
+	}
+	verBytes, ok := r.bytes(4)
+	if !ok {
+		return nil, errNotQUICInitial
+	}
+	version := binary.BigEndian.Uint32(verBytes)
+	packetType := (first >> 4) & 0x03
+	switch {
+	case version == quicVersion1 && packetType == 0:
+	case version == quicVersion2 && packetType == 1:
+	default:
+		return nil, errNotQUICInitial
+	}
+
+	dcid, ok := r.u8Prefixed()
+	if !ok || len(dcid.data)-dcid.pos > 20 {
+		return nil, fmt.Errorf("invalid destination connection id")
+	}
+	if _, ok := r.u8Prefixed(); !ok {
+		return nil, fmt.Errorf("invalid source connection id")
+	}
+	tokenLen, ok := readQUICVarint(r)
+	if !ok {
+		return nil, fmt.Errorf("invalid token length")
+	}
+	if tokenLen > uint64(len(datagram)) {
+		return nil, fmt.Errorf("truncated token")
+	}
+	if _, ok := r.bytes(int(tokenLen)); !ok {
+		return nil, fmt.Errorf("truncated token")
+	}
+	length, ok := readQUICVarint(r)
+	if !ok || length > uint64(len(datagram)-r.pos) {
+		return nil, fmt.Errorf("invalid packet length")
+	}
+	pnOffset := r.pos
+	end := pnOffset + int(length)
+	// The header protection sample starts 4 bytes after the packet number.
+	if end < pnOffset+4+aes.BlockSize {
+		return nil, fmt.Errorf("packet too short for header protection sample")
+	}
+
+	keys, err := deriveQUICInitialKeys(version, dcid.data[dcid.pos:])
+	if err != nil {
+		return nil, err
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, datagram[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := make([]byte, pnOffset+4)
+	copy(header, datagram[:pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	nonce := make([]byte, len(keys.iv))
+	copy(nonce, keys.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return keys.aead.Open(nil, nonce, datagram[pnOffset+pnLen:end], header)
+}
+
+// quicCryptoAssembler collects CRYPTO frame data from Initial packets, which
+// may arrive out of order and spread over several datagrams.
+type quicCryptoAssembler struct {
+	frags map[uint64][]byte
+}
+
+func newQUICCryptoAssembler() *quicCryptoAssembler {
+	return &quicCryptoAssembler{frags: make(map[uint64][]byte)}
+}
+
+// addFrames records the CRYPTO frames carried in a decrypted Initial payload.
+func (a *quicCryptoAssembler) addFrames(payload []byte) error {
+	r := &helloReader{data: payload}
+	for !r.empty() {
+		frameType, ok := readQUICVarint(r)
+		if !ok {
+			return fmt.Errorf("truncated frame type")
+		}
+		switch frameType {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			var rangeCount uint64
+			for i := 0; i < 4; i++ {
+				v, ok := readQUICVarint(r)
+				if !ok {
+					return fmt.Errorf("truncated ACK frame")
+				}
+				if i == 2 {
+					rangeCount = v
+				}
+			}
+			extra := 2 * rangeCount
+			if frameType == 0x03 {
+				extra += 3 // ECN counts
+			}
+			for i := uint64(0); i < extra; i++ {
+				if _, ok := readQUICVarint(r); !ok {
+					return fmt.Errorf("truncated ACK frame")
+				}
+			}
+		case 0x06: // CRYPTO
+			offset, ok := readQUICVarint(r)
+			if !ok {
+				return fmt.Errorf("truncated CRYPTO frame")
+			}
+			length, ok := readQUICVarint(r)
+			if !ok || length > uint64(len(payload)) {
+				return fmt.Errorf("truncated CRYPTO frame")
+			}
+			data, ok := r.bytes(int(length))
+			if !ok || offset+length > maxClientHelloLen {
+				return fmt.Errorf("invalid CRYPTO frame")
+			}
+			if len(a.frags[offset]) < len(data) {
+				a.frags[offset] = append([]byte(nil), data...)
+			}
+		case 0x1c, 0x1d: // CONNECTION_CLOSE
+			return fmt.Errorf("connection close in Initial")
+		default:
+			return fmt.Errorf("unexpected frame type %#x in Initial", frameType)
+		}
+	}
+	return nil
+}
+
+// clientHello returns the ClientHello handshake message once the crypto
+// stream holds it completely from offset 0.
+func (a *quicCryptoAssembler) clientHello() ([]byte, bool) {
+	var stream []byte
+	for {
+		next := uint64(len(stream))
+		var ext []byte
+		for off, data := range a.frags {
+			end := off + uint64(len(data))
+			if off <= next && end > next && end-next > uint64(len(ext)) {
+				ext = data[next-off:]
+			}
+		}
+		if ext == nil {
+			break
+		}
+		stream = append(stream, ext...)
+	}
+	if len(stream) < 4 {
+		return nil, false
+	}
+	msgLen := int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3])
+	if len(stream) < 4+msgLen {
+		return nil, false
+	}
+	return stream[:4+msgLen], true
+}
+
+// handleQUICConnection sniffs the SNI from a client's QUIC Initial packets
+// and applies the matched rule's QUIC policy. Rewriting the SNI of a QUIC
+// handshake isn't possible without terminating QUIC, so matched domains are
+// blocked by default to push the client back to TCP, where the HTTPS path
+// handles them.
+func handleQUICConnection(localConn net.Conn, targetAddr string) {
+	defer func() {
+		if r := recover(); r != nil {
+			LogError("PANIC in handleQUICConnection: %v", r)
+		}
+		localConn.Close()
+	}()
+
+	var pending [][]byte
+	asm := newQUICCryptoAssembler()
+	sni := ""
+	buf := make([]byte, 65535)
+
+	localConn.SetReadDeadline(time.Now().Add(quicSniffTimeout))
+	for len(pending) < maxQUICSniffPackets {
+		n, err := localConn.Read(buf)
+		if err != nil {
+			if len(pending) == 0 {
+				LogDebug("QUIC: Read failed for %s: %v", targetAddr, err)
+				return
+			}
+			break
+		}
+		pending = append(pending, append([]byte(nil), buf[:n]...))
+
+		payload, err := decryptQUICInitial(buf[:n])
+		if err != nil {
+			LogDebug("QUIC: Not sniffing %s: %v", targetAddr, err)
+			break
+		}
+		if err := asm.addFrames(payload); err != nil {
+			LogDebug("QUIC: Initial frames for %s: %v", targetAddr, err)
+			break
+		}
+		if hello, ok := asm.clientHello(); ok {
+			if ch, err := parseClientHello(hello); err == nil {
+				sni = ch.ServerName()
+			} else {
+				LogDebug("QUIC: ClientHello parse error for %s: %v", targetAddr, err)
+			}
+			break
+		}
+	}
+	localConn.SetReadDeadline(time.Time{})
+
+	if sni != "" {
+		if rule := globalEngine.Match(sni); rule != nil {
+			policy := rule.QUIC
+			if policy == "" {
+				policy = quicPolicyBlock
+			}
+			if policy == quicPolicyBlock {
+				LogInfo("QUIC SNI: %s (BLOCKED, forcing TCP fallback)", sni)
+				drainQUIC(localConn)
+				return
+			}
+			LogInfo("QUIC SNI: %s (PASS)", sni)
+		} else {
+			LogInfo("QUIC Direct: %s", sni)
+		}
+	}
+
+	relayUDP(localConn, targetAddr, pending)
+}
+
+// drainQUIC swallows further datagrams of a blocked flow until it goes idle,
+// so retransmitted Initials don't spawn a new handler each time.
+func drainQUIC(localConn net.Conn) {
+	buf := make([]byte, 65535)
+	for {
+		localConn.SetReadDeadline(time.Now().Add(quicBlockIdle))
+		if _, err := localConn.Read(buf); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// RFC 9001 Appendix A.1 client Initial key derivation.
+func TestQUICInitialKeyDerivation(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	initial, err := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := hkdfExpandLabel(initial, "client in", 32)
+	key, _ := hkdfExpandLabel(client, "quic key", 16)
+	iv, _ := hkdfExpandLabel(client, "quic iv", 12)
+	hp, _ := hkdfExpandLabel(client, "quic hp", 16)
+
+	for _, tc := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"client_initial_secret", client, "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea"},
+		{"key", key, "1f369613dd76d5467730efcbe3b1a22d"},
+		{"iv", iv, "fa044b2f42a3fd3b46fb255c"},
+		{"hp", hp, "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if hex.EncodeToString(tc.got) != tc.want {
+			t.Errorf("%s = %x, want %s", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func appendQUICVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	default:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	}
+}
+
+// sealQUICInitial builds a protected v1 client Initial carrying frames.
+func sealQUICInitial(t *testing.T, dcid []byte, pn uint32, frames []byte) []byte {
+	t.Helper()
+	keys, err := deriveQUICInitialKeys(quicVersion1, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(frames) < 1100 {
+		frames = append(frames, 0) // PADDING
+	}
+	hdr := []byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, 0, 0) // empty SCID and token
+	hdr = appendQUICVarint(hdr, uint64(4+len(frames)+keys.aead.Overhead()))
+	pnOffset := len(hdr)
+	hdr = binary.BigEndian.AppendUint32(hdr, pn)
+
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	pkt := keys.aead.Seal(append([]byte(nil), hdr...), nonce, frames, hdr)
+
+	mask := make([]byte, 16)
+	keys.hp.Encrypt(mask, pkt[pnOffset+4:pnOffset+20])
+	pkt[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+	}
+	return pkt
+}
+
+func cryptoFrame(offset int, data []byte) []byte {
+	f := []byte{0x06}
+	f = appendQUICVarint(f, uint64(offset))
+	f = appendQUICVarint(f, uint64(len(data)))
+	return append(f, data...)
+}
+
+func TestQUICInitialSNI(t *testing.T) {
+	hello := captureClientHello(t, "quic.example.com", []string{"h3"})[recordHeaderLen:]
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	mid := len(hello) / 2
+
+	// Second half first, in separate datagrams, with a PING and an ACK mixed in.
+	second := append([]byte{0x01, 0x02, 0, 0, 0, 0}, cryptoFrame(mid, hello[mid:])...)
+	first := cryptoFrame(0, hello[:mid])
+
+	asm := newQUICCryptoAssembler()
+	for i, frames := range [][]byte{second, first} {
+		payload, err := decryptQUICInitial(sealQUICInitial(t, dcid, uint32(i), frames))
+		if err != nil {
+			t.Fatalf("decrypt packet %d: %v", i, err)
+		}
+		if err := asm.addFrames(payload); err != nil {
+			t.Fatalf("frames of packet %d: %v", i, err)
+		}
+		if _, ok := asm.clientHello(); ok != (i == 1) {
+			t.Fatalf("clientHello complete after packet %d = %v", i, ok)
+		}
+	}
+
+	got, _ := asm.clientHello()
+	ch, err := parseClientHello(got)
+	if err != nil || ch.ServerName() != "quic.example.com" {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+
+	if _, err := decryptQUICInitial([]byte{0x40, 1, 2, 3}); err != errNotQUICInitial {
+		t.Fatalf("short header packet: err = %v", err)
+	}
+}
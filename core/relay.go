@@ -0,0 +1,163 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A tunnel with no traffic in either direction for this long is closed.
+	tcpRelayIdle = 5 * time.Minute
+	udpRelayIdle = time.Minute
+
+	relayBufferSize = 32 * 1024
+)
+
+// closeWriter is implemented by connections that can be half-closed: TCP
+// (a FIN) and TLS (a close_notify).
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (c *upstreamConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *PrefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// relayStats is what a finished relay moved: Up from the local side to the
+// remote, Down the other way.
+type relayStats struct {
+	Up       int64
+	Down     int64
+	Duration time.Duration
+	Err      error
+}
+
+func (s relayStats) String() string {
+	str := fmt.Sprintf("up %d bytes, down %d bytes in %s", s.Up, s.Down, s.Duration.Round(time.Millisecond))
+	if s.Err != nil {
+		str += fmt.Sprintf(" (%v)", s.Err)
+	}
+	return str
+}
+
+// relay copies between local and remote until both directions are done.
+// When one side finishes cleanly its peer is half-closed, so the other
+// direction can still drain; if the peer can't be half-closed, or a side
+// fails, or nothing moves for idle, both directions are stopped. The caller
+// still owns and closes both connections.
+func relay(local, remote net.Conn, idle time.Duration) relayStats {
+	r := &relayState{idle: idle}
+	r.touch()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var up, down int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		down = r.copyHalf(local, remote)
+	}()
+	up = r.copyHalf(remote, local)
+	wg.Wait()
+
+	return relayStats{Up: up, Down: down, Duration: time.Since(start), Err: r.err}
+}
+
+type relayState struct {
+	idle         time.Duration
+	lastActivity atomic.Int64
+	aborted      atomic.Bool
+	errOnce      sync.Once
+	err          error
+}
+
+func (r *relayState) touch() {
+	r.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (r *relayState) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - r.lastActivity.Load())
+}
+
+// abort unblocks both directions by expiring their deadlines.
+func (r *relayState) abort(dst, src net.Conn, err error) {
+	if err != nil {
+		r.errOnce.Do(func() { r.err = err })
+	}
+	r.aborted.Store(true)
+	now := time.Now()
+	dst.SetDeadline(now)
+	src.SetDeadline(now)
+}
+
+// copyHalf copies src to dst and returns the number of bytes written. Read
+// deadlines are renewed while the other direction is active, so a one-way
+// transfer doesn't count as idle.
+func (r *relayState) copyHalf(dst, src net.Conn) int64 {
+	buf := make([]byte, relayBufferSize)
+	var written int64
+	for {
+		if r.aborted.Load() {
+			return written
+		}
+		src.SetReadDeadline(time.Now().Add(r.idle - r.idleFor()))
+		// An abort between the check above and this deadline would be
+		// overwritten by it; look again so the read doesn't block for idle.
+		if r.aborted.Load() {
+			return written
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.touch()
+			dst.SetWriteDeadline(time.Now().Add(r.idle))
+			wn, werr := dst.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				r.abort(dst, src, werr)
+				return written
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if isTimeout(err) {
+			if r.aborted.Load() {
+				return written
+			}
+			if r.idleFor() < r.idle {
+				continue
+			}
+			r.abort(dst, src, fmt.Errorf("idle for %s", r.idle))
+			return written
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				return written
+			}
+			r.abort(dst, src, nil)
+			return written
+		}
+		r.abort(dst, src, err)
+		return written
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	client, local := tcpPair(t)
+	remote, server := tcpPair(t)
+
+	// The server only answers once the client is done sending.
+	go func() {
+		req, _ := io.ReadAll(server)
+		server.Write([]byte("got " + string(req)))
+		server.Close()
+	}()
+
+	done := make(chan relayStats, 1)
+	go func() { done <- relay(local, remote, time.Minute) }()
+
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "got hello" {
+		t.Fatalf("response %q, err %v", resp, err)
+	}
+
+	select {
+	case stats := <-done:
+		if stats.Up != 5 || stats.Down != 9 || stats.Err != nil {
+			t.Fatalf("stats: %s", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not finish")
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	_, local := tcpPair(t)
+	remote, _ := tcpPair(t)
+
+	start := time.Now()
+	stats := relay(local, remote, 200*time.Millisecond)
+	if stats.Err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("idle relay: %s after %s", stats, time.Since(start))
+	}
+}
+
+func TestRelayAbortStopsIdleDirection(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		client, local := tcpPair(t)
+		remote, _ := tcpPair(t)
+
+		done := make(chan relayStats, 1)
+		go func() { done <- relay(local, remote, time.Minute) }()
+
+		// The client resets its end while the remote never sends anything.
+		client.(*net.TCPConn).SetLinger(0)
+		client.Close()
+
+		select {
+		case stats := <-done:
+			if stats.Err == nil {
+				t.Fatalf("reset not reported: %s", stats)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("relay kept waiting on the idle direction")
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultScanConcurrency = 32
+	defaultScanBest        = 5
+	defaultScanPerCIDR     = 256
+	defaultScanTimeout     = 3 * time.Second
+	maxScanIPs             = 1 << 16
+	// maxScanConcurrency caps the sockets a scan holds open at once.
+	maxScanConcurrency = 256
+	// Throughput is measured by downloading at most this much, for at most
+	// scanThroughputTime.
+	scanThroughputBytes = 1 << 20
+	scanThroughputTime  = 5 * time.Second
+)
+
+// ScanOptions configures ScanFrontIPs.
+type ScanOptions struct {
+	CIDRs []string `json:"cidrs"`
+	// SNI is sent in the handshake; empty sends none.
+	SNI string `json:"sni"`
+	// VerifyHost is the name the certificate must be valid for. Defaults to
+	// SNI.
+	VerifyHost  string `json:"verify_host"`
+	Port        int    `json:"port"`
+	Concurrency int    `json:"concurrency"`
+	Best        int    `json:"best"`
+	// PerCIDR caps how many addresses are tried from each range; larger
+	// ranges are sampled at random.
+	PerCIDR   int `json:"per_cidr"`
+	TimeoutMs int `json:"timeout_ms"`
+	// ThroughputPath, if set, is fetched over HTTP/1.1 from the fastest
+	// candidates to rank them by download speed instead of latency.
+	ThroughputPath string `json:"throughput_path"`
+}
+
+// ScanResult is one front IP that completed a verified TLS handshake.
+type ScanResult struct {
+	IP             string `json:"ip"`
+	LatencyMs      int64  `json:"latency_ms"`
+	ThroughputKbps int64  `json:"throughput_kbps,omitempty"`
+}
+
+// ScanReport is what ScanFrontIPs returns. TargetIP joins the best IPs in the
+// format of a rule's target_ip, so it can be saved into a rule as is.
+type ScanReport struct {
+	Results  []ScanResult `json:"results"`
+	Scanned  int          `json:"scanned"`
+	TargetIP string       `json:"target_ip"`
+}
+
+var (
+	scanMu     sync.Mutex
+	scanCancel context.CancelFunc
+)
+
+// ScanFrontIPs searches the given ranges for IPs that serve a valid
+// certificate for the target host and returns the best ones as a JSON
+// ScanReport. optionsJSON is a ScanOptions. Only one scan runs at a time;
+// CancelScan stops it early, returning what was found so far.
+func ScanFrontIPs(optionsJSON string) (string, error) {
+	var opts ScanOptions
+	if err := json.Unmarshal([]byte(optionsJSON), &opts); err != nil {
+		return "", fmt.Errorf("scan options parse error: %v", err)
+	}
+	ips, err := scanCandidates(opts.CIDRs, opts.PerCIDR)
+	if err != nil {
+		return "", err
+	}
+	if opts.SNI == "" && opts.VerifyHost == "" {
+		return "", fmt.Errorf("sni or verify_host is required")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scanMu.Lock()
+	if scanCancel != nil {
+		scanMu.Unlock()
+		cancel()
+		return "", fmt.Errorf("a scan is already running")
+	}
+	scanCancel = cancel
+	scanMu.Unlock()
+	defer func() {
+		scanMu.Lock()
+		scanCancel = nil
+		scanMu.Unlock()
+		cancel()
+	}()
+
+	report := scanFronts(ctx, ips, &opts)
+	data, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// CancelScan stops a running ScanFrontIPs.
+func CancelScan() {
+	scanMu.Lock()
+	if scanCancel != nil {
+		scanCancel()
+	}
+	scanMu.Unlock()
+}
+
+// scanCandidates lists the addresses to try from cidrs, taking at most
+// perCIDR from each. Plain IPs are accepted as single-address ranges.
+func scanCandidates(cidrs []string, perCIDR int) ([]netip.Addr, error) {
+	if perCIDR <= 0 {
+		perCIDR = defaultScanPerCIDR
+	}
+	var ips []netip.Addr
+	seen := make(map[netip.Addr]bool)
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(c)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid range %q: %v", c, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefix = prefix.Masked()
+
+		hostBits := prefix.Addr().BitLen() - prefix.Bits()
+		if hostBits < 31 && 1<<hostBits <= perCIDR {
+			for a := prefix.Addr(); prefix.Contains(a); a = a.Next() {
+				if !seen[a] {
+					seen[a] = true
+					ips = append(ips, a)
+				}
+			}
+		} else {
+			added := 0
+			for tries := 0; added < perCIDR && tries < perCIDR*4 && len(ips) < maxScanIPs; tries++ {
+				if a := randomAddrIn(prefix); !seen[a] {
+					seen[a] = true
+					ips = append(ips, a)
+					added++
+				}
+			}
+		}
+		if len(ips) >= maxScanIPs {
+			break
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses to scan")
+	}
+	rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	return ips, nil
+}
+
+func randomAddrIn(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	bits := prefix.Bits()
+	for i := range b {
+		if keep := bits - 8*i; keep < 8 {
+			var mask byte
+			if keep > 0 {
+				mask = ^byte(0) << (8 - keep)
+			}
+			b[i] = b[i]&mask | byte(rand.UintN(256))&^mask
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func scanFronts(ctx context.Context, ips []netip.Addr, opts *ScanOptions) *ScanReport {
+	port := opts.Port
+	if port <= 0 {
+		port = 443
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultScanConcurrency
+	}
+	if concurrency > maxScanConcurrency {
+		concurrency = maxScanConcurrency
+	}
+	best := opts.Best
+	if best <= 0 {
+		best = defaultScanBest
+	}
+	timeout := defaultScanTimeout
+	if opts.TimeoutMs > 0 {
+		timeout = time.Duration(opts.TimeoutMs) * time.Millisecond
+	}
+	verifyHost := opts.VerifyHost
+	if verifyHost == "" {
+		verifyHost = opts.SNI
+	}
+
+	LogInfo("Scan: Probing %d addresses for %s (SNI: %q, concurrency %d)", len(ips), verifyHost, opts.SNI, concurrency)
+
+	var (
+		mu      sync.Mutex
+		found   []ScanResult
+		scanned int
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, ip := range ips {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(ip netip.Addr) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			latency, err := scanHandshake(ctx, addr, opts.SNI, verifyHost, timeout)
+			mu.Lock()
+			scanned++
+			if err == nil {
+				found = append(found, ScanResult{IP: ip.String(), LatencyMs: latency.Milliseconds()})
+			}
+			mu.Unlock()
+		}(ip)
+	}
+	wg.Wait()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].LatencyMs < found[j].LatencyMs })
+
+	if opts.ThroughputPath != "" && ctx.Err() == nil {
+		// Only the fastest handshakes are worth a download.
+		if len(found) > 2*best {
+			found = found[:2*best]
+		}
+		for i := range found {
+			if ctx.Err() != nil {
+				break
+			}
+			addr := net.JoinHostPort(found[i].IP, strconv.Itoa(port))
+			kbps, err := scanThroughput(ctx, addr, opts.SNI, verifyHost, opts.ThroughputPath, timeout)
+			if err != nil {
+				LogDebug("Scan: Throughput test for %s failed: %v", found[i].IP, err)
+				continue
+			}
+			found[i].ThroughputKbps = kbps
+		}
+		sort.SliceStable(found, func(i, j int) bool { return found[i].ThroughputKbps > found[j].ThroughputKbps })
+	}
+
+	if len(found) > best {
+		found = found[:best]
+	}
+	report := &ScanReport{Results: found, Scanned: scanned}
+	if report.Results == nil {
+		report.Results = []ScanResult{}
+	}
+	bestIPs := make([]string, len(found))
+	for i, r := range found {
+		bestIPs[i] = r.IP
+	}
+	report.TargetIP = strings.Join(bestIPs, ", ")
+	LogInfo("Scan: %d of %d addresses passed for %s: %s", len(found), scanned, verifyHost, report.TargetIP)
+	return report
+}
+
+// scanTLSConfig sends sni but checks the certificate against verifyHost, so
+// fronts can be tested with a different (or no) SNI.
+func scanTLSConfig(sni, verifyHost string) *tls.Config {
+	return &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, c := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       verifyHost,
+				Roots:         trustedRoots(),
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
+
+func scanHandshake(ctx context.Context, addr, sni, verifyHost string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := getProtectedDialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, scanTLSConfig(sni, verifyHost))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// scanThroughput downloads path from addr and returns the rate in kbit/s.
+func scanThroughput(ctx context.Context, addr, sni, verifyHost, path string, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout+scanThroughputTime)
+	defer cancel()
+
+	conn, err := getProtectedDialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, scanTLSConfig(sni, verifyHost))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: snirect\r\nConnection: close\r\n\r\n", path, verifyHost)
+	start := time.Now()
+	if _, err := tlsConn.Write([]byte(req)); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(tlsConn, scanThroughputBytes))
+	elapsed := time.Since(start)
+	if n == 0 {
+		return 0, fmt.Errorf("no data: %v", err)
+	}
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	return n * 8 * int64(time.Second) / int64(elapsed) / 1000, nil
+}
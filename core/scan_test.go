@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScanCandidates(t *testing.T) {
+	ips, err := scanCandidates([]string{"192.0.2.0/28", "192.0.2.5", "198.51.100.0/16", "2001:db8::/32"}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	seen := make(map[netip.Addr]bool)
+	for _, ip := range ips {
+		if seen[ip] {
+			t.Fatalf("duplicate candidate %s", ip)
+		}
+		seen[ip] = true
+		for _, p := range []string{"192.0.2.0/28", "198.51.0.0/16", "2001:db8::/32"} {
+			if netip.MustParsePrefix(p).Contains(ip) {
+				counts[p]++
+			}
+		}
+	}
+	if counts["192.0.2.0/28"] != 16 || counts["198.51.0.0/16"] != 64 || counts["2001:db8::/32"] != 64 || len(ips) != 144 {
+		t.Fatalf("candidate counts = %v (total %d)", counts, len(ips))
+	}
+
+	if _, err := scanCandidates([]string{"not-a-range"}, 0); err == nil {
+		t.Fatal("invalid range accepted")
+	}
+}
+
+func TestScanFronts(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	trustTestRoot(t, srv.Certificate())
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	// Only 127.0.0.1 has the server listening.
+	ips := []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}
+	report := scanFronts(context.Background(), ips, &ScanOptions{SNI: "example.com", Port: portNum, TimeoutMs: 1000})
+	if report.Scanned != 2 || len(report.Results) != 1 || report.TargetIP != "127.0.0.1" {
+		t.Fatalf("report = %+v", report)
+	}
+	if r := report.Results[0]; r.IP != "127.0.0.1" || r.LatencyMs < 0 || r.LatencyMs > 1000 {
+		t.Fatalf("result = %+v", r)
+	}
+
+	// A certificate that isn't valid for the host is dropped too.
+	report = scanFronts(context.Background(), ips, &ScanOptions{SNI: "example.com", VerifyHost: "other.scan-test.invalid", Port: portNum, TimeoutMs: 1000})
+	if len(report.Results) != 0 {
+		t.Fatalf("unverified front reported: %+v", report)
+	}
+}
+
+func TestCancelScan(t *testing.T) {
+	// The front accepts connections but never answers the ClientHello.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	done := make(chan string, 1)
+	go func() {
+		out, err := ScanFrontIPs(fmt.Sprintf(`{"cidrs": ["127.0.0.1"], "sni": "example.com", "port": %d, "timeout_ms": 30000}`, port))
+		if err != nil {
+			out = err.Error()
+		}
+		done <- out
+	}()
+
+	for running := false; !running; {
+		time.Sleep(10 * time.Millisecond)
+		scanMu.Lock()
+		running = scanCancel != nil
+		scanMu.Unlock()
+	}
+	start := time.Now()
+	CancelScan()
+
+	select {
+	case out := <-done:
+		var report ScanReport
+		if err := json.Unmarshal([]byte(out), &report); err != nil || len(report.Results) != 0 {
+			t.Fatalf("report %q: %v", out, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("scan took %s to stop", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan still running after CancelScan")
+	}
+}
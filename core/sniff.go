@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+const (
+	protoUnknown = iota
+	protoTLS
+	protoHTTP
+)
+
+const (
+	// sniffTimeout bounds how long we wait for the client's first bytes.
+	// Server-first protocols send nothing, so they are forwarded as unknown
+	// once it expires.
+	sniffTimeout = 500 * time.Millisecond
+	// sniffMinBytes is enough to recognise every HTTP method below.
+	sniffMinBytes = 8
+)
+
+// Ports where the server speaks first, so waiting for client bytes would only
+// add latency, plus implicit-TLS mail, which no rule targets. Used when
+// Config.NoSniffPorts is unset.
+var defaultNoSniffPorts = []int{21, 22, 25, 110, 143, 465, 587, 993, 995, 3306}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+// sniffPolicy decides which destination ports get protocol detection.
+type sniffPolicy struct {
+	allow map[int]bool // empty means every port not denied
+	deny  map[int]bool
+}
+
+func newSniffPolicy(cfg *Config) *sniffPolicy {
+	p := &sniffPolicy{allow: make(map[int]bool), deny: make(map[int]bool)}
+	deny := defaultNoSniffPorts
+	if cfg != nil {
+		for _, port := range cfg.SniffPorts {
+			p.allow[port] = true
+		}
+		if cfg.NoSniffPorts != nil {
+			deny = cfg.NoSniffPorts
+		}
+	}
+	for _, port := range deny {
+		p.deny[port] = true
+	}
+	return p
+}
+
+func (p *sniffPolicy) shouldSniff(port int) bool {
+	if p.deny[port] {
+		return false
+	}
+	return len(p.allow) == 0 || p.allow[port]
+}
+
+// detectProtocol classifies the first bytes a client sent.
+func detectProtocol(b []byte) int {
+	if len(b) >= 3 && b[0] == recordTypeHandshake && b[1] == 0x03 {
+		return protoTLS
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return protoHTTP
+		}
+	}
+	return protoUnknown
+}
+
+// sniffConn reads the client's first bytes without consuming them for the
+// handler: the returned bytes must be replayed (see PrefixConn).
+func sniffConn(conn net.Conn) []byte {
+	buf := make([]byte, 4096)
+	n := 0
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	for n < sniffMinBytes {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+		if detectProtocol(buf[:n]) == protoTLS {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return buf[:n]
+}
+
+// handleTCPConnection picks a handler for a forwarded TCP connection from
+// what the client sends first, regardless of the destination port.
+func handleTCPConnection(conn net.Conn, dest string, port int, policy *sniffPolicy) {
+	if !policy.shouldSniff(port) {
+		forwardDirect(conn, dest, nil)
+		return
+	}
+
+	peeked := sniffConn(conn)
+	switch detectProtocol(peeked) {
+	case protoTLS:
+		handleProxyConnection(&PrefixConn{Conn: conn, Prefix: peeked}, dest, nil)
+	case protoHTTP:
+		handleHTTPConnection(&PrefixConn{Conn: conn, Prefix: peeked}, dest)
+	default:
+		LogDebug("Sniff: Unknown protocol to %s (%d bytes peeked)", dest, len(peeked))
+		forwardDirect(conn, dest, peeked)
+	}
+}
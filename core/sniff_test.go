@@ -0,0 +1,38 @@
+package core
+
+import "testing"
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{"\x16\x03\x01\x02\x00\x01", protoTLS},
+		{"GET / HTTP/1.1\r\n", protoHTTP},
+		{"CONNECT example.com:443 HTTP/1.1\r\n", protoHTTP},
+		{"SSH-2.0-OpenSSH_9.6\r\n", protoUnknown},
+		{"GETX", protoUnknown},
+		{"", protoUnknown},
+	}
+	for _, tt := range tests {
+		if got := detectProtocol([]byte(tt.data)); got != tt.want {
+			t.Errorf("detectProtocol(%q) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestSniffPolicy(t *testing.T) {
+	def := newSniffPolicy(nil)
+	if !def.shouldSniff(8443) || def.shouldSniff(25) {
+		t.Errorf("default policy: 8443=%v 25=%v", def.shouldSniff(8443), def.shouldSniff(25))
+	}
+
+	p := newSniffPolicy(&Config{SniffPorts: []int{443, 2053}, NoSniffPorts: []int{2053}})
+	if !p.shouldSniff(443) || p.shouldSniff(2053) || p.shouldSniff(80) {
+		t.Errorf("configured policy: 443=%v 2053=%v 80=%v", p.shouldSniff(443), p.shouldSniff(2053), p.shouldSniff(80))
+	}
+
+	if !newSniffPolicy(&Config{NoSniffPorts: []int{}}).shouldSniff(25) {
+		t.Errorf("explicit empty deny list should sniff every port")
+	}
+}
@@ -67,6 +67,8 @@ func NewTunStack(fd int, config *Config, cb EngineCallbacks) (*TunStack, error)
 		{Destination: header.IPv6EmptySubnet, NIC: 1},
 	})
 
+	sniff := newSniffPolicy(config)
+
 	// Use a large receive window
 	f := tcp.NewForwarder(s, 0, 10000, func(r *tcp.ForwarderRequest) {
 		defer func() {
@@ -106,12 +108,13 @@ func NewTunStack(fd int, config *Config, cb EngineCallbacks) (*TunStack, error)
 			return
 		}
 
-		LogDebug("TCP Forwarder: Starting proxy handler...")
-		if id.LocalPort == 443 {
-			go handleProxyConnection(conn, dest, nil)
-		} else {
-			go forwardDirect(conn, dest, nil)
+		if id.LocalPort == 53 {
+			go handleDNSTCPConnection(conn)
+			return
 		}
+
+		LogDebug("TCP Forwarder: Starting proxy handler...")
+		go handleTCPConnection(conn, dest, int(id.LocalPort), sniff)
 		LogDebug("TCP Forwarder: Handler started")
 	})
 	s.SetTransportProtocolHandler(tcp.ProtocolNumber, f.HandlePacket)
@@ -136,6 +139,11 @@ func NewTunStack(fd int, config *Config, cb EngineCallbacks) (*TunStack, error)
 			return true
 		}
 
+		if r.ID().LocalPort == 443 {
+			go handleQUICConnection(gonet.NewUDPConn(&wq, uep), dest)
+			return true
+		}
+
 		go handleUDPForwardDirect(gonet.NewUDPConn(&wq, uep), dest)
 		return true
 	})
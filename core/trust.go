@@ -0,0 +1,132 @@
+package core
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/x509roots/fallback/bundle"
+)
+
+// trustDirName is the directory under dataDir holding extra PEM bundles
+// (*.pem, *.crt) to trust upstream, on top of the bundled Mozilla roots.
+const trustDirName = "trust"
+
+// trustStore is the root pool for every upstream verification: MITM
+// upstreams, DoT, DoH and FetchRemote. Android's system roots aren't
+// reliably reachable from Go, so the Mozilla set is bundled.
+var trustStore = struct {
+	sync.RWMutex
+	pool       *x509.CertPool
+	generation int
+}{}
+
+// trustedRoots returns the current root pool, loading it on first use.
+func trustedRoots() *x509.CertPool {
+	trustStore.RLock()
+	pool := trustStore.pool
+	trustStore.RUnlock()
+	if pool != nil {
+		return pool
+	}
+	if err := ReloadTrustStore(); err != nil {
+		LogWarn("Trust: %v", err)
+	}
+	trustStore.RLock()
+	defer trustStore.RUnlock()
+	return trustStore.pool
+}
+
+// trustGeneration changes every time the trust store is reloaded, so holders
+// of long-lived TLS configs know to rebuild them.
+func trustGeneration() int {
+	trustStore.RLock()
+	defer trustStore.RUnlock()
+	return trustStore.generation
+}
+
+// ReloadTrustStore rebuilds the upstream root pool from the bundled roots and
+// the PEM files in dataDir/trust. Files that fail to parse are skipped and
+// reported in the returned error; the new pool is installed regardless.
+func ReloadTrustStore() error {
+	pool := x509.NewCertPool()
+	bundled := 0
+	for root := range bundle.Roots() {
+		cert, err := x509.ParseCertificate(root.Certificate)
+		if err != nil {
+			continue
+		}
+		pool.AddCertWithConstraint(cert, root.Constraint)
+		bundled++
+	}
+
+	user, errs := loadUserRoots(pool)
+
+	trustStore.Lock()
+	trustStore.pool = pool
+	trustStore.generation++
+	trustStore.Unlock()
+
+	LogInfo("Trust: Loaded %d bundled and %d user root certificates", bundled, user)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to load user roots: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func loadUserRoots(pool *x509.CertPool) (int, []string) {
+	if dataDir == "" {
+		return 0, nil
+	}
+	dir := filepath.Join(dataDir, trustDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, []string{err.Error()}
+	}
+
+	count := 0
+	var errs []string
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		n := 0
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", e.Name(), err))
+				continue
+			}
+			pool.AddCert(cert)
+			n++
+		}
+		if n == 0 {
+			errs = append(errs, fmt.Sprintf("%s: no certificates", e.Name()))
+			continue
+		}
+		LogDebug("Trust: %d certificates from %s", n, e.Name())
+		count += n
+	}
+	return count, errs
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadTrustStoreUserRoots(t *testing.T) {
+	oldDir := dataDir
+	dataDir = t.TempDir()
+	defer func() {
+		dataDir = oldDir
+		ReloadTrustStore()
+	}()
+
+	chain := testChain(t, t.TempDir())
+	if _, err := chain[0].Verify(x509.VerifyOptions{DNSName: "pinned.example.com", Roots: trustedRoots()}); err == nil {
+		t.Fatal("private CA trusted before it was added")
+	}
+
+	dir := filepath.Join(dataDir, trustDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[1].Raw})
+	if err := os.WriteFile(filepath.Join(dir, "corp.pem"), pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.crt"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gen := trustGeneration()
+	if err := ReloadTrustStore(); err == nil {
+		t.Fatal("broken bundle not reported")
+	}
+	if trustGeneration() == gen {
+		t.Fatal("generation not bumped on reload")
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{DNSName: "pinned.example.com", Roots: trustedRoots()}); err != nil {
+		t.Fatalf("user root not trusted after reload: %v", err)
+	}
+}
+
+// trustTestRoot adds root to the trust store for the rest of the test.
+func trustTestRoot(t *testing.T, root *x509.Certificate) {
+	t.Helper()
+	oldDir := dataDir
+	dataDir = t.TempDir()
+	t.Cleanup(func() {
+		dataDir = oldDir
+		ReloadTrustStore()
+	})
+	dir := filepath.Join(dataDir, trustDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	if err := os.WriteFile(filepath.Join(dir, "test.pem"), pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadTrustStore(); err != nil {
+		t.Fatal(err)
+	}
+}